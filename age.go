@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"filippo.io/age"
+	"go.starlark.net/starlark"
+)
+
+const defaultAgeIdentity = "~/.config/environ/key.txt"
+
+var (
+	ageHeader = []byte("age-encryption.org/v1\n")
+	// Local file header, or end of central directory for an empty archive
+	zipHeaders = [][]byte{[]byte("PK\x03\x04"), []byte("PK\x05\x06")}
+)
+
+func isZip(data []byte) bool {
+	for _, header := range zipHeaders {
+		if bytes.HasPrefix(data, header) {
+			return true
+		}
+	}
+	return false
+}
+
+// PlaintextArchive is returned by encrypting remotes when an archive is not encrypted
+type PlaintextArchive struct {
+	key    string
+	remote Remote
+}
+
+func (e PlaintextArchive) Error() string {
+	return fmt.Sprintf("archive %s in %s is not encrypted; set allow_plaintext = True to read it while migrating", e.key, e.remote)
+}
+
+func plaintextArchive(key string, remote Remote) PlaintextArchive {
+	return PlaintextArchive{key: key, remote: remote}
+}
+
+// readPlaintext handles archives pushed to of before encryption was enabled:
+// unless allowed, they are refused, since anyone with write access to of
+// could plant one. It reports whether content was such an archive.
+func readPlaintext(key string, content []byte, of Remote, allowed bool) ([]byte, bool, error) {
+	if !isZip(content) {
+		return nil, false, nil
+	}
+	if !allowed {
+		return nil, true, plaintextArchive(key, of)
+	}
+	log.Printf("Warning: archive %s in %s is not encrypted", key, of)
+	return content, true, nil
+}
+
+func agefunc(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var of Remote
+	var recipients *starlark.List
+	identity := ""
+	allowPlaintext := false
+	if err := starlark.UnpackArgs(fn.Name(), args, kwargs, "of", &of, "recipients", &recipients, "identity?", &identity, "allow_plaintext?", &allowPlaintext); err != nil {
+		return nil, err
+	}
+	if identity == "" {
+		identity = defaultAgeIdentity
+	}
+	if recipients.Len() == 0 {
+		return nil, fmt.Errorf("%s: at least one recipient is required", fn.Name())
+	}
+	parsed := make([]age.Recipient, recipients.Len())
+	for i := 0; i < recipients.Len(); i++ {
+		s, ok := recipients.Index(i).(starlark.String)
+		if !ok {
+			return nil, fmt.Errorf("%s: recipient %s is not a string", fn.Name(), recipients.Index(i))
+		}
+		recipient, err := age.ParseX25519Recipient(s.GoString())
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid recipient %s: %w", fn.Name(), s, err)
+		}
+		parsed[i] = recipient
+	}
+	return Age{
+		Of:             of,
+		recipients:     parsed,
+		identity:       expandHome(identity),
+		allowPlaintext: allowPlaintext,
+	}, nil
+}
+
+// Age encrypts archives to a set of age recipients before handing them to Of,
+// and decrypts them with the local identity file on the way back
+type Age struct {
+	Of         Remote
+	recipients []age.Recipient
+	identity   string
+	// allowPlaintext is passed to readPlaintext
+	allowPlaintext bool
+}
+
+func (a Age) identities() ([]age.Identity, error) {
+	file, err := os.Open(a.identity)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open age identity: %w", err)
+	}
+	defer file.Close()
+	identities, err := age.ParseIdentities(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse age identity %s: %w", a.identity, err)
+	}
+	return identities, nil
+}
+
+func (a Age) encrypt(value []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	writer, err := age.Encrypt(&buf, a.recipients...)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := writer.Write(value); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (a Age) Get(key string) ([]byte, error) {
+	content, err := a.Of.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(content, ageHeader) {
+		if plaintext, ok, err := readPlaintext(key, content, a.Of, a.allowPlaintext); ok {
+			return plaintext, err
+		}
+		return nil, fmt.Errorf("archive %s is neither age-encrypted nor a ZIP", key)
+	}
+	identities, err := a.identities()
+	if err != nil {
+		return nil, err
+	}
+	reader, err := age.Decrypt(bytes.NewReader(content), identities...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt archive %s with %s: %w", key, a.identity, err)
+	}
+	return io.ReadAll(reader)
+}
+
+func (a Age) Write(key string, value []byte) error {
+	encrypted, err := a.encrypt(value)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt archive %s: %w", key, err)
+	}
+	return a.Of.Write(key, encrypted)
+}
+
+func (a Age) Overwrite(key string, value []byte) error {
+	encrypted, err := a.encrypt(value)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt archive %s: %w", key, err)
+	}
+	return overwrite(a.Of, key, encrypted)
+}
+
+func (a Age) Unwrap() []Remote {
+	return []Remote{a.Of}
+}
+
+func (a Age) String() string {
+	return fmt.Sprintf("age(%s)", a.Of)
+}
+
+func (a Age) Type() string {
+	return "Age"
+}
+
+func (a Age) Freeze() {
+}
+
+func (a Age) Truth() starlark.Bool {
+	return starlark.Bool(true)
+}
+
+func (a Age) Hash() (uint32, error) {
+	return starlark.String(a.String()).Hash()
+}
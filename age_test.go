@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"filippo.io/age"
+)
+
+func TestAgeRoundTrip(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatalf("failed to generate identity: %v", err)
+	}
+	identityPath := filepath.Join(t.TempDir(), "key.txt")
+	if err := os.WriteFile(identityPath, []byte(identity.String()+"\n"), 0600); err != nil {
+		t.Fatalf("failed to write identity: %v", err)
+	}
+
+	inner := memoryRemote{}
+	remote := Age{
+		Of:         inner,
+		recipients: []age.Recipient{identity.Recipient()},
+		identity:   identityPath,
+	}
+
+	archive := zipData(t, map[string]string{".env": "SECRET=value\n"})
+	if err := remote.Write("key", archive); err != nil {
+		t.Fatalf("Write returned error: %v", err)
+	}
+	if bytes.Contains(inner["key"], []byte("SECRET=value")) || !bytes.HasPrefix(inner["key"], ageHeader) {
+		t.Fatalf("expected stored archive to be age-encrypted")
+	}
+
+	decrypted, err := remote.Get("key")
+	if err != nil {
+		t.Fatalf("Get returned error: %v", err)
+	}
+	if !bytes.Equal(decrypted, archive) {
+		t.Fatalf("decrypted archive does not match original")
+	}
+}
+
+func TestAgeRejectsPlaintextArchives(t *testing.T) {
+	archive := zipData(t, map[string]string{".env": "SECRET=planted\n"})
+	inner := memoryRemote{"key": archive}
+	remote := Age{Of: inner, identity: filepath.Join(t.TempDir(), "missing.txt")}
+
+	var plaintext PlaintextArchive
+	if _, err := remote.Get("key"); !errors.As(err, &plaintext) {
+		t.Fatalf("expected PlaintextArchive, got %v", err)
+	}
+
+	remote.allowPlaintext = true
+	content, err := remote.Get("key")
+	if err != nil || !bytes.Equal(content, archive) {
+		t.Fatalf("expected plaintext archive with allow_plaintext, got %v", err)
+	}
+}
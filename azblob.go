@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
+	"go.starlark.net/starlark"
+)
+
+func azblobfunc(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	account := ""
+	container := ""
+	prefix := ""
+	endpoint := ""
+	if err := starlark.UnpackArgs(fn.Name(), args, kwargs, "account", &account, "container", &container, "prefix?", &prefix, "endpoint?", &endpoint); err != nil {
+		return nil, err
+	}
+	if prefix == "" {
+		prefix = "environ"
+	}
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://%s.blob.core.windows.net/", account)
+	}
+	var client *azblob.Client
+	// A shared key, e.g. for an emulator, or else Azure AD credentials
+	if key := os.Getenv("AZURE_STORAGE_KEY"); key != "" {
+		credential, err := azblob.NewSharedKeyCredential(account, key)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", fn.Name(), err)
+		}
+		if client, err = azblob.NewClientWithSharedKeyCredential(endpoint, credential, nil); err != nil {
+			return nil, fmt.Errorf("%s: %w", fn.Name(), err)
+		}
+	} else {
+		credential, err := azidentity.NewDefaultAzureCredential(nil)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", fn.Name(), err)
+		}
+		if client, err = azblob.NewClient(endpoint, credential, nil); err != nil {
+			return nil, fmt.Errorf("%s: %w", fn.Name(), err)
+		}
+	}
+	return AzBlob{
+		client:    client,
+		account:   account,
+		container: container,
+		prefix:    prefix,
+	}, nil
+}
+
+type AzBlob struct {
+	client    *azblob.Client
+	account   string
+	container string
+	prefix    string
+}
+
+func (a AzBlob) Get(key string) ([]byte, error) {
+	resp, err := a.client.DownloadStream(context.Background(), a.container, a.prefix+"/"+key, nil)
+	if err != nil {
+		return []byte{}, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return []byte{}, err
+	}
+	return body, nil
+}
+
+func (a AzBlob) Exists(key string) (bool, error) {
+	_, err := a.client.ServiceClient().NewContainerClient(a.container).NewBlobClient(a.prefix+"/"+key).GetProperties(context.Background(), nil)
+	if bloberror.HasCode(err, bloberror.BlobNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func realAzBlobWriteError(err error) bool {
+	return err != nil && !bloberror.HasCode(err, bloberror.BlobAlreadyExists, bloberror.ConditionNotMet)
+}
+
+func (a AzBlob) Write(key string, value []byte) error {
+	_, err := a.client.UploadBuffer(context.Background(), a.container, a.prefix+"/"+key, value, &azblob.UploadBufferOptions{
+		AccessConditions: &blob.AccessConditions{
+			ModifiedAccessConditions: &blob.ModifiedAccessConditions{IfNoneMatch: to.Ptr(azcore.ETagAny)},
+		},
+	})
+	if realAzBlobWriteError(err) {
+		return err
+	}
+	return nil
+}
+
+func (a AzBlob) Overwrite(key string, value []byte) error {
+	// In a single request like Write, rather than staged blocks
+	_, err := a.client.UploadBuffer(context.Background(), a.container, a.prefix+"/"+key, value, nil)
+	return err
+}
+
+func (a AzBlob) String() string {
+	return fmt.Sprintf("azblob(%s, %s, %s)", a.account, a.container, a.prefix)
+}
+
+func (a AzBlob) Type() string {
+	return "AzBlob"
+}
+
+func (a AzBlob) Freeze() {
+}
+
+func (a AzBlob) Truth() starlark.Bool {
+	return starlark.Bool(true)
+}
+
+func (a AzBlob) Hash() (uint32, error) {
+	return starlark.String(a.String()).Hash()
+}
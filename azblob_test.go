@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"go.starlark.net/starlark"
+)
+
+// fakeAzBlob serves single-request blob uploads and downloads, answering
+// uploads with If-None-Match: * to existing blobs with conflict and its code
+func fakeAzBlob(t *testing.T, conflict int, conflictCode string) (*httptest.Server, map[string][]byte) {
+	t.Helper()
+	var mu sync.Mutex
+	blobs := make(map[string][]byte)
+	fail := func(w http.ResponseWriter, status int, code string) {
+		w.Header().Set("x-ms-error-code", code)
+		w.Header().Set("Content-Type", "application/xml")
+		w.WriteHeader(status)
+		fmt.Fprintf(w, `<?xml version="1.0" encoding="utf-8"?><Error><Code>%s</Code><Message>%s</Message></Error>`, code, code)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "SharedKey devstoreaccount1:") {
+			fail(w, http.StatusForbidden, "AuthenticationFailed")
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		content, exists := blobs[r.URL.Path]
+		switch r.Method {
+		case http.MethodGet, http.MethodHead:
+			if !exists {
+				fail(w, http.StatusNotFound, "BlobNotFound")
+				return
+			}
+			w.Header().Set("Content-Length", fmt.Sprint(len(content)))
+			w.Header().Set("ETag", `"0x1"`)
+			w.Header().Set("x-ms-blob-type", "BlockBlob")
+			w.WriteHeader(http.StatusOK)
+			w.Write(content)
+		case http.MethodPut:
+			if exists && r.Header.Get("If-None-Match") == "*" {
+				fail(w, conflict, conflictCode)
+				return
+			}
+			blobs[r.URL.Path], _ = io.ReadAll(r.Body)
+			w.Header().Set("ETag", `"0x1"`)
+			w.WriteHeader(http.StatusCreated)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server, blobs
+}
+
+// newFakeAzBlob declares an azblob remote pointed at server with endpoint
+func newFakeAzBlob(t *testing.T, server *httptest.Server) AzBlob {
+	t.Helper()
+	t.Setenv("AZURE_STORAGE_KEY", base64.StdEncoding.EncodeToString([]byte("key")))
+	kwargs := []starlark.Tuple{
+		{starlark.String("account"), starlark.String("devstoreaccount1")},
+		{starlark.String("container"), starlark.String("environ")},
+		{starlark.String("endpoint"), starlark.String(server.URL + "/devstoreaccount1")},
+	}
+	value, err := starlark.Call(&starlark.Thread{}, starlark.NewBuiltin("azblob", azblobfunc), nil, kwargs)
+	if err != nil {
+		t.Fatalf("azblob returned error: %v", err)
+	}
+	return value.(AzBlob)
+}
+
+func TestAzBlobWriteTreatsConflictsAsExisting(t *testing.T) {
+	for _, test := range []struct {
+		status int
+		code   string
+	}{
+		{http.StatusConflict, "BlobAlreadyExists"},
+		{http.StatusPreconditionFailed, "ConditionNotMet"},
+	} {
+		t.Run(test.code, func(t *testing.T) {
+			server, blobs := fakeAzBlob(t, test.status, test.code)
+			remote := newFakeAzBlob(t, server)
+			for _, content := range []string{"first", "second"} {
+				if err := remote.Write("id", []byte(content)); err != nil {
+					t.Fatalf("Write returned error: %v", err)
+				}
+			}
+			if content := blobs["/devstoreaccount1/environ/environ/id"]; string(content) != "first" {
+				t.Fatalf("expected first content to be kept, got %q", content)
+			}
+		})
+	}
+
+	server, _ := fakeAzBlob(t, http.StatusForbidden, "AuthorizationPermissionMismatch")
+	remote := newFakeAzBlob(t, server)
+	if err := remote.Write("id", []byte("first")); err != nil {
+		t.Fatalf("Write returned error: %v", err)
+	}
+	if err := remote.Write("id", []byte("second")); err == nil {
+		t.Fatalf("expected other errors than conflicts to be returned")
+	}
+}
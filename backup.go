@@ -0,0 +1,253 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// keptBackups is how many backups of each environ are kept, the oldest
+// being removed first
+const keptBackups = 20
+
+func backupDir() (string, bool) {
+	dir, ok := stateDir()
+	if !ok {
+		return "", false
+	}
+	return filepath.Join(dir, "backups"), true
+}
+
+// backupStore keeps the backups of an environ, encrypted with the key of its
+// encrypted local cache if it has one
+func backupStore(dir, environName string) Local {
+	store := Local{path: dir, key: expandHome(defaultLocalKey)}
+	if environ, ok := environs[environName]; ok {
+		walkRemotes(environ.Remote, func(remote Remote) {
+			if l, ok := remote.(Local); ok && l.encrypt && !store.encrypt {
+				store.encrypt, store.key = true, l.key
+			}
+		})
+	}
+	return store
+}
+
+// backupEnviron is the environ a backup ID was made for
+func backupEnviron(id string) string {
+	_, environName, _ := strings.Cut(id, "-")
+	return environName
+}
+
+// writeBackup saves the current content of the files a transaction is about to
+// replace, as a ZIP in the backup directory, and returns the backup ID. The
+// comment of each entry is its hash in state, restored along with it.
+func writeBackup(environName string, transaction *fileTransaction, state syncState) (string, error) {
+	dir, ok := backupDir()
+	if !ok {
+		return "", nil
+	}
+
+	var buf bytes.Buffer
+	zipWriter := zip.NewWriter(&buf)
+	files := 0
+	for _, staged := range transaction.staged {
+		if !staged.existed {
+			continue
+		}
+		header := &zip.FileHeader{
+			Name:    staged.name,
+			Method:  zip.Deflate,
+			Comment: state.Files[staged.name],
+		}
+		header.SetMode(staged.previousMode)
+		fileWriter, err := zipWriter.CreateHeader(header)
+		if err != nil {
+			return "", fmt.Errorf("failed to create backup entry for %q: %w", staged.name, err)
+		}
+		if _, err := fileWriter.Write(staged.previous); err != nil {
+			return "", fmt.Errorf("failed to write %q to backup: %w", staged.name, err)
+		}
+		files++
+	}
+	if err := zipWriter.Close(); err != nil {
+		return "", fmt.Errorf("failed to finalize backup: %w", err)
+	}
+	if files == 0 {
+		return "", nil
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", fmt.Errorf("failed to create backup directory: %w", err)
+	}
+	id := time.Now().UTC().Format("20060102T150405.000Z") + "-" + environName
+	if err := backupStore(dir, environName).Write(id+".zip", buf.Bytes()); err != nil {
+		return "", fmt.Errorf("failed to write backup: %w", err)
+	}
+	if err := pruneBackups(dir, environName); err != nil {
+		return "", fmt.Errorf("failed to remove old backups: %w", err)
+	}
+	return id, nil
+}
+
+// backupIDs lists the backups in dir, oldest first
+func backupIDs(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, entry := range entries {
+		if id, ok := strings.CutSuffix(entry.Name(), ".zip"); ok {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// pruneBackups removes the oldest backups of an environ beyond keptBackups
+func pruneBackups(dir, environName string) error {
+	ids, err := backupIDs(dir)
+	if err != nil {
+		return err
+	}
+	var own []string
+	for _, id := range ids {
+		if backupEnviron(id) == environName {
+			own = append(own, id)
+		}
+	}
+	for len(own) > keptBackups {
+		if err := os.Remove(filepath.Join(dir, own[0]+".zip")); err != nil {
+			return err
+		}
+		own = own[1:]
+	}
+	return nil
+}
+
+// readBackup returns the ZIP of a backup, decrypted if needed
+func readBackup(dir, id string) (*zip.Reader, error) {
+	content, err := backupStore(dir, backupEnviron(id)).Get(id + ".zip")
+	if err != nil {
+		return nil, err
+	}
+	return zip.NewReader(bytes.NewReader(content), int64(len(content)))
+}
+
+// commitWithBackup backs up the files a transaction replaces before committing
+// it, along with their hashes in state
+func commitWithBackup(environName string, transaction *fileTransaction, state syncState) error {
+	id, err := writeBackup(environName, transaction, state)
+	if err != nil {
+		return err
+	}
+	if err := transaction.Commit(); err != nil {
+		return err
+	}
+	if id != "" {
+		log.Printf("Previous content saved as backup %s", id)
+	}
+	return nil
+}
+
+func listBackups() error {
+	dir, ok := backupDir()
+	if !ok {
+		return fmt.Errorf("backups are only kept in git repositories")
+	}
+	ids, err := backupIDs(dir)
+	if os.IsNotExist(err) || (err == nil && len(ids) == 0) {
+		fmt.Println("No backups")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		zipReader, err := readBackup(dir, id)
+		if err != nil {
+			return fmt.Errorf("failed to read backup %s: %w", id, err)
+		}
+		var names []string
+		for _, file := range zipReader.File {
+			names = append(names, file.Name)
+		}
+		fmt.Printf("%s: %s\n", id, strings.Join(names, ", "))
+	}
+	return nil
+}
+
+// restoreBackup puts back the files saved in a backup, itself backing up
+// the content it replaces, and their hashes in the sync state as of the backup
+func restoreBackup(id string) error {
+	dir, ok := backupDir()
+	if !ok {
+		return fmt.Errorf("backups are only kept in git repositories")
+	}
+	id = filepath.Base(id)
+	zipReader, err := readBackup(dir, id)
+	if err != nil {
+		return fmt.Errorf("failed to open backup %s: %w", id, err)
+	}
+	if err := validateZip(zipReader); err != nil {
+		return err
+	}
+
+	root, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	environName := backupEnviron(id)
+	state, err := loadState(environName)
+	if err != nil {
+		return err
+	}
+	restoredState := syncState{ArchiveID: state.ArchiveID, Files: map[string]string{}}
+	for name, hash := range state.Files {
+		restoredState.Files[name] = hash
+	}
+
+	var transaction fileTransaction
+	defer transaction.Abort()
+	for _, file := range zipReader.File {
+		if err := checkWritablePath(root, file.Name); err != nil {
+			return err
+		}
+		if file.Comment != "" {
+			restoredState.Files[file.Name] = file.Comment
+		} else {
+			delete(restoredState.Files, file.Name)
+		}
+		content, err := readZipFileContent(file)
+		if err != nil {
+			return fmt.Errorf("failed to read file %s from backup: %w", file.Name, err)
+		}
+		hasChanged, err := fileHasChanged(file.Name, content)
+		if err != nil {
+			return fmt.Errorf("failed to check if file %s has changed: %w", file.Name, err)
+		}
+		if !hasChanged {
+			continue
+		}
+		if err := transaction.Stage(file.Name, content, file.Mode().Perm()); err != nil {
+			return err
+		}
+	}
+
+	restored := len(transaction.staged)
+	if err := commitWithBackup(environName, &transaction, state); err != nil {
+		return err
+	}
+	if err := saveState(environName, restoredState); err != nil {
+		return err
+	}
+	log.Printf("Restored %d/%d files from backup %s", restored, len(zipReader.File), id)
+	return nil
+}
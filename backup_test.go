@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRestoreBackupUndoesPull(t *testing.T) {
+	t.Chdir(t.TempDir())
+	if err := exec.Command("git", "init", "-q").Run(); err != nil {
+		t.Skipf("git is not available: %v", err)
+	}
+	if err := os.WriteFile(".env", []byte("OLD=1\n"), 0640); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+
+	var transaction fileTransaction
+	if err := transaction.Stage(".env", []byte("NEW=1\n"), 0600); err != nil {
+		t.Fatalf("Stage returned error: %v", err)
+	}
+	if err := transaction.Stage(".env.prod", []byte("NEW=1\n"), 0600); err != nil {
+		t.Fatalf("Stage returned error: %v", err)
+	}
+	id, err := writeBackup("test", &transaction, syncState{})
+	if err != nil {
+		t.Fatalf("writeBackup returned error: %v", err)
+	}
+	if err := transaction.Commit(); err != nil {
+		t.Fatalf("Commit returned error: %v", err)
+	}
+
+	if err := restoreBackup(id); err != nil {
+		t.Fatalf("restoreBackup returned error: %v", err)
+	}
+	content, err := os.ReadFile(".env")
+	if err != nil || string(content) != "OLD=1\n" {
+		t.Fatalf("expected .env to be restored, got %q (%v)", content, err)
+	}
+	info, err := os.Stat(".env")
+	if err != nil || info.Mode().Perm() != 0640 {
+		t.Fatalf("expected .env to get back mode 0640, got %v (%v)", info.Mode().Perm(), err)
+	}
+	// Files created by the pull were not in the backup
+	if _, err := os.Stat(".env.prod"); err != nil {
+		t.Fatalf("expected .env.prod to be left alone, got %v", err)
+	}
+}
+
+func TestRestoreBackupRestoresSyncState(t *testing.T) {
+	environ := testEnviron(t, ".env")
+	writeFile(t, ".env", "A=1\n", 0600)
+	if err := push(environ); err != nil {
+		t.Fatalf("push returned error: %v", err)
+	}
+	pushElsewhere(t, environ, map[string]string{".env": "A=2\n"})
+	if err := pull(environ, pullOptions{}); err != nil {
+		t.Fatalf("pull returned error: %v", err)
+	}
+	dir, _ := backupDir()
+	ids, err := backupIDs(dir)
+	if err != nil || len(ids) != 1 {
+		t.Fatalf("expected one backup, got %v (%v)", ids, err)
+	}
+
+	if err := restoreBackup(ids[0]); err != nil {
+		t.Fatalf("restoreBackup returned error: %v", err)
+	}
+	if content := readFile(t, ".env"); content != "A=1\n" {
+		t.Fatalf("expected .env to be restored, got %q", content)
+	}
+	state, err := loadState(environ.Name)
+	if err != nil {
+		t.Fatalf("loadState returned error: %v", err)
+	}
+	if modified, err := state.locallyModified(".env"); err != nil || modified {
+		t.Fatalf("expected the restored .env to be in sync as before the pull, got %v (%v)", modified, err)
+	}
+}
+
+func TestBackupsAreEncryptedWithTheLocalCacheKey(t *testing.T) {
+	environ := testEnviron(t, ".env")
+	environ.Remote = Local{path: t.TempDir(), encrypt: true, key: filepath.Join(t.TempDir(), "local.key")}
+	environs[environ.Name] = environ
+	t.Cleanup(func() { delete(environs, environ.Name) })
+	writeFile(t, ".env", "SECRET=old\n", 0600)
+
+	var transaction fileTransaction
+	if err := transaction.Stage(".env", []byte("SECRET=new\n"), 0600); err != nil {
+		t.Fatalf("Stage returned error: %v", err)
+	}
+	if err := commitWithBackup(environ.Name, &transaction, syncState{}); err != nil {
+		t.Fatalf("commitWithBackup returned error: %v", err)
+	}
+	dir, _ := backupDir()
+	ids, err := backupIDs(dir)
+	if err != nil || len(ids) != 1 {
+		t.Fatalf("expected one backup, got %v (%v)", ids, err)
+	}
+	content, err := os.ReadFile(filepath.Join(dir, ids[0]+".zip"))
+	if err != nil || !bytes.HasPrefix(content, localHeader) || bytes.Contains(content, []byte("SECRET")) {
+		t.Fatalf("expected the backup to be encrypted (%v)", err)
+	}
+
+	if err := restoreBackup(ids[0]); err != nil {
+		t.Fatalf("restoreBackup returned error: %v", err)
+	}
+	if content := readFile(t, ".env"); content != "SECRET=old\n" {
+		t.Fatalf("expected .env to be restored, got %q", content)
+	}
+}
+
+func TestWriteBackupKeepsTheLastBackups(t *testing.T) {
+	testEnviron(t, ".env")
+	write := func(environName string) {
+		t.Helper()
+		writeFile(t, ".env", "A=1\n", 0600)
+		var transaction fileTransaction
+		if err := transaction.Stage(".env", []byte("A=2\n"), 0600); err != nil {
+			t.Fatalf("Stage returned error: %v", err)
+		}
+		if err := commitWithBackup(environName, &transaction, syncState{}); err != nil {
+			t.Fatalf("commitWithBackup returned error: %v", err)
+		}
+		// Backup IDs have millisecond precision
+		time.Sleep(2 * time.Millisecond)
+	}
+	write("other")
+	for i := 0; i < keptBackups+2; i++ {
+		write("test")
+	}
+
+	dir, _ := backupDir()
+	ids, err := backupIDs(dir)
+	if err != nil || len(ids) != keptBackups+1 {
+		t.Fatalf("expected %d backups, got %d (%v)", keptBackups+1, len(ids), err)
+	}
+	if backupEnviron(ids[0]) != "other" {
+		t.Fatalf("expected backups of other environs to be kept, got %v", ids[0])
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"log"
 
 	"go.starlark.net/starlark"
 )
@@ -22,20 +23,54 @@ type Cache struct {
 	Of Remote
 }
 
+// verifyContent checks that a plaintext archive hashes to its archive ID.
+// Anything else, such as signatures or archives encrypted below the cache, is
+// verified by fetchArchive once decrypted.
+func verifyContent(key string, content []byte) error {
+	if !isArchiveID(key) || !isZip(content) {
+		return nil
+	}
+	return verifyArchive(key, content)
+}
+
 func (c Cache) Get(key string) ([]byte, error) {
-	if cached, err := c.By.Get(key); err == nil {
-		return cached, nil
+	cached, err := c.By.Get(key)
+	if err == nil {
+		if verifyContent(key, cached) == nil {
+			return cached, nil
+		}
+		log.Printf("Replacing corrupted cache entry %s", key)
+		return c.Refresh(key)
 	}
 	content, err := c.Of.Get(key)
 	if err != nil {
 		return nil, err
 	}
+	// Never cache what doesn't verify
+	if err := verifyContent(key, content); err != nil {
+		return nil, err
+	}
 	if err := c.By.Write(key, content); err != nil {
 		return nil, err
 	}
 	return content, nil
 }
 
+// Refresh replaces the cached copy of key with the one in Of
+func (c Cache) Refresh(key string) ([]byte, error) {
+	content, err := c.Of.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyContent(key, content); err != nil {
+		return nil, err
+	}
+	if err := overwrite(c.By, key, content); err != nil {
+		return nil, err
+	}
+	return content, nil
+}
+
 func (c Cache) Write(key string, value []byte) error {
 	if err := c.Of.Write(key, value); err != nil {
 		return err
@@ -43,6 +78,17 @@ func (c Cache) Write(key string, value []byte) error {
 	return c.By.Write(key, value)
 }
 
+func (c Cache) Overwrite(key string, value []byte) error {
+	if err := overwrite(c.Of, key, value); err != nil {
+		return err
+	}
+	return overwrite(c.By, key, value)
+}
+
+func (c Cache) Unwrap() []Remote {
+	return []Remote{c.By, c.Of}
+}
+
 func (c Cache) String() string {
 	return fmt.Sprintf("Cache(%s, %s)", c.By, c.Of)
 }
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/peter-evans/patience"
+)
+
+// environDiff is the difference between two archives of an environ
+type environDiff struct {
+	Environ string `json:"environ"`
+	From    string `json:"from"`
+	To      string `json:"to"`
+	// Local is set when To is the archive ID of the working files
+	Local bool       `json:"local"`
+	Files []fileDiff `json:"files"`
+
+	fromLabel, toLabel string
+}
+
+// fileDiff is how a file differs between both sides of a diff
+type fileDiff struct {
+	Name string `json:"name"`
+	// Status is added, removed, modified, or missing for a tracked file missing locally
+	Status string     `json:"status"`
+	Hunks  []diffHunk `json:"hunks,omitempty"`
+	Keys   []keyDiff  `json:"keys,omitempty"`
+	// Error is why the file could not be diffed key by key
+	Error string `json:"error,omitempty"`
+
+	// keyed is set when Keys was computed, even if empty
+	keyed bool
+	// text is the line diff as printed
+	text string
+}
+
+// diffHunk is a hunk of a unified diff, with its lines prefixed by " ", "-" or "+"
+type diffHunk struct {
+	Header string   `json:"header"`
+	Lines  []string `json:"lines"`
+}
+
+// keyDiff is a changed key or path, with its values as shown by diffOptions.value
+type keyDiff struct {
+	Op   string `json:"op"`
+	Path string `json:"path"`
+	From string `json:"from,omitempty"`
+	To   string `json:"to,omitempty"`
+}
+
+// diffOptions control how changed files are compared and printed
+type diffOptions struct {
+	// keys diffs dotenv, JSON, YAML and tfvars files key by key instead of line by line
+	keys bool
+	// formats overrides the format of files, see fileFormat
+	formats map[string]string
+	// showValues prints the values in key diffs instead of salted hashes
+	showValues bool
+	// salt is random for each run, so value hashes can't be compared across runs
+	salt []byte
+	// json prints the diff as JSON rather than text
+	json bool
+}
+
+// newDiffOptions returns options with a new salt. JSON output, meant for CI
+// logs and scripts, implies keys.
+func newDiffOptions(keys, showValues, asJSON bool) (diffOptions, error) {
+	options := diffOptions{keys: keys || asJSON, showValues: showValues, json: asJSON, salt: make([]byte, 16)}
+	if showValues && !options.keys {
+		// Line diffs always show values, so the flag would be meaningless
+		return options, fmt.Errorf("-show-values needs -keys or -format=json")
+	}
+	if _, err := rand.Read(options.salt); err != nil {
+		return options, err
+	}
+	return options, nil
+}
+
+// value is how a value is shown in key diffs
+func (o diffOptions) value(value string) string {
+	if o.showValues {
+		return value
+	}
+	mac := hmac.New(sha256.New, o.salt)
+	mac.Write([]byte(value))
+	return "#" + hex.EncodeToString(mac.Sum(nil))[:8]
+}
+
+func diffRange(length int) string {
+	if length == 0 {
+		return "0,0"
+	}
+	return fmt.Sprintf("1,%d", length)
+}
+
+// singleSidedDiff diffs a file that is only on one side, from or to being nil
+func singleSidedDiff(fileName, fromLabel, toLabel string, fromContent, toContent []byte) (string, diffHunk) {
+	fromLines := splitLines(fromContent)
+	toLines := splitLines(toContent)
+
+	hunk := diffHunk{Header: fmt.Sprintf("@@ -%s +%s @@", diffRange(len(fromLines)), diffRange(len(toLines))), Lines: []string{}}
+	for _, line := range fromLines {
+		hunk.Lines = append(hunk.Lines, "-"+line)
+	}
+	for _, line := range toLines {
+		hunk.Lines = append(hunk.Lines, "+"+line)
+	}
+
+	var text strings.Builder
+	fmt.Fprintf(&text, "--- %s (%s)\n", fileName, fromLabel)
+	fmt.Fprintf(&text, "+++ %s (%s)\n", fileName, toLabel)
+	fmt.Fprintf(&text, "%s\n", hunk.Header)
+	for _, line := range hunk.Lines {
+		fmt.Fprintf(&text, "%s\n", line)
+	}
+	return text.String(), hunk
+}
+
+// unifiedDiff diffs a file on both sides with one line of context
+func unifiedDiff(fileName, fromLabel, toLabel string, fromContent, toContent []byte) (string, []diffHunk) {
+	diff := patience.Diff(strings.Split(string(fromContent), "\n"), strings.Split(string(toContent), "\n"))
+	options := patience.UnifiedDiffOptions{Precontext: 1, Postcontext: 1}
+	var hunks []diffHunk
+	for _, line := range strings.Split(patience.UnifiedDiffTextWithOptions(diff, options), "\n") {
+		switch {
+		case strings.HasPrefix(line, "@@"):
+			hunks = append(hunks, diffHunk{Header: line, Lines: []string{}})
+		case len(hunks) == 0:
+			continue
+		case line == "":
+			// Empty context lines are printed without their prefix
+			hunks[len(hunks)-1].Lines = append(hunks[len(hunks)-1].Lines, " ")
+		default:
+			hunks[len(hunks)-1].Lines = append(hunks[len(hunks)-1].Lines, line)
+		}
+	}
+	options.SrcHeader = fmt.Sprintf("%s (%s)", fileName, fromLabel)
+	options.DstHeader = fmt.Sprintf("%s (%s)", fileName, toLabel)
+	return patience.UnifiedDiffTextWithOptions(diff, options), hunks
+}
+
+// diffFile compares a file, from or to being nil if it is only on one side
+func diffFile(fileName, status, fromLabel, toLabel string, fromContent, toContent []byte, options diffOptions) fileDiff {
+	file := fileDiff{Name: fileName, Status: status}
+	if format := fileFormat(fileName, options.formats); options.keys && format != formatText {
+		changes, err := structuredChanges(format, fromContent, toContent)
+		if err == nil {
+			file.keyed = true
+			for _, change := range changes {
+				key := keyDiff{Op: change.Op, Path: change.Path}
+				if change.Op != "+" {
+					key.From = options.value(change.From)
+				}
+				if change.Op != "-" {
+					key.To = options.value(change.To)
+				}
+				file.Keys = append(file.Keys, key)
+			}
+			return file
+		}
+		file.Error = fmt.Sprintf("cannot diff %s as %s: %s", fileName, format, err)
+		if !options.showValues {
+			// A line diff would show the values
+			return file
+		}
+	}
+	if fromContent == nil || toContent == nil {
+		var hunk diffHunk
+		file.text, hunk = singleSidedDiff(fileName, fromLabel, toLabel, fromContent, toContent)
+		file.Hunks = []diffHunk{hunk}
+	} else {
+		file.text, file.Hunks = unifiedDiff(fileName, fromLabel, toLabel, fromContent, toContent)
+	}
+	return file
+}
+
+// compareZips lists the files that differ between two archives, sorted by name
+func compareZips(fromZipData, toZipData []byte, fromLabel, toLabel string, options diffOptions) ([]fileDiff, error) {
+	fromContents, err := zipContents(fromZipData)
+	if err != nil {
+		return nil, fmt.Errorf("invalid 'from' ZIP: %w", err)
+	}
+	toContents, err := zipContents(toZipData)
+	if err != nil {
+		return nil, fmt.Errorf("invalid 'to' ZIP: %w", err)
+	}
+
+	// Sort files for consistent output
+	var fileList []string
+	for name := range fromContents {
+		fileList = append(fileList, name)
+	}
+	for name := range toContents {
+		if _, ok := fromContents[name]; !ok {
+			fileList = append(fileList, name)
+		}
+	}
+	sort.Strings(fileList)
+
+	files := []fileDiff{}
+	for _, fileName := range fileList {
+		fromContent, fromExists := fromContents[fileName]
+		toContent, toExists := toContents[fileName]
+		switch {
+		case !fromExists:
+			files = append(files, diffFile(fileName, "added", fromLabel, toLabel, nil, toContent, options))
+		case !toExists:
+			files = append(files, diffFile(fileName, "removed", fromLabel, toLabel, fromContent, nil, options))
+		case !bytes.Equal(fromContent, toContent):
+			files = append(files, diffFile(fileName, "modified", fromLabel, toLabel, fromContent, toContent, options))
+		}
+	}
+	return files, nil
+}
+
+// printFileDiff prints the changes to a file as text
+func printFileDiff(file fileDiff, fromLabel, toLabel string) {
+	switch {
+	case file.Status == "added":
+		fmt.Printf("!!! file %s only in %s\n", file.Name, toLabel)
+	case file.Status == "removed" || (file.Status == "missing" && (file.text != "" || file.keyed || file.Error != "")):
+		fmt.Printf("!!! file %s only in %s\n", file.Name, fromLabel)
+	}
+	if file.Error != "" {
+		fmt.Printf("!!! %s\n", file.Error)
+	}
+	if file.keyed {
+		fmt.Printf("--- %s (%s)\n", file.Name, fromLabel)
+		fmt.Printf("+++ %s (%s)\n", file.Name, toLabel)
+		if len(file.Keys) == 0 {
+			fmt.Println("  (only comments, order or formatting changed)")
+		}
+		for _, key := range file.Keys {
+			switch key.Op {
+			case "+":
+				fmt.Printf("+ %s=%s\n", key.Path, key.To)
+			case "-":
+				fmt.Printf("- %s=%s\n", key.Path, key.From)
+			case "~":
+				fmt.Printf("~ %s=%s -> %s\n", key.Path, key.From, key.To)
+			}
+		}
+	}
+	fmt.Print(file.text)
+}
+
+func printEnvironDiff(diff environDiff) {
+	for _, file := range diff.Files {
+		if file.Status == "missing" {
+			fmt.Printf("!!! tracked file %s missing locally; treating as absent in diff target\n", file.Name)
+		}
+	}
+	for _, file := range diff.Files {
+		printFileDiff(file, diff.fromLabel, diff.toLabel)
+	}
+}
+
+func diffAll(environNames []string, from, to string, options diffOptions) (bool, error) {
+	var anyDiff bool
+	var withHunks []string
+	diffs := []environDiff{}
+	for _, environName := range environNames {
+		environ, ok := environs[environName]
+		if !ok {
+			return anyDiff, envNotFound(environName)
+		}
+
+		diff, err := diffEnviron(environ, from, to, options)
+		if err != nil {
+			return anyDiff, fmt.Errorf("failed to diff %s: %w", environName, err)
+		}
+		if len(diff.Files) > 0 {
+			anyDiff = true
+		}
+		if options.json {
+			diffs = append(diffs, diff)
+			for _, file := range diff.Files {
+				if len(file.Hunks) > 0 {
+					withHunks = append(withHunks, file.Name)
+				}
+			}
+		} else {
+			printEnvironDiff(diff)
+		}
+	}
+	if options.json {
+		if len(withHunks) > 0 && !options.showValues {
+			// Text files have no keys to hash, and CI logs are kept
+			log.Printf("Warning: the JSON diff holds the changed lines of %s", strings.Join(withHunks, ", "))
+		}
+		out, err := json.MarshalIndent(diffs, "", "  ")
+		if err != nil {
+			return anyDiff, err
+		}
+		fmt.Println(string(out))
+	}
+	return anyDiff, nil
+}
+
+// diffEnviron compares two archives of an environ, by default its ref and the working files
+func diffEnviron(environ Environ, from, to string, options diffOptions) (environDiff, error) {
+	diff := environDiff{Environ: environ.Name}
+
+	// Resolve from parameter (default to ref file content)
+	fromSource := from
+	if fromSource == "" {
+		ref, err := readRefFile(environ.Ref)
+		if err != nil {
+			return diff, err
+		}
+		fromSource = ref
+	}
+
+	// Get ZIP data for comparison
+	fromZipData, fromID, err := getZipFromSource(environ, fromSource)
+	if err != nil {
+		return diff, fmt.Errorf("failed to get 'from' source: %w", err)
+	}
+	diff.From = fromID
+
+	var toZipData []byte
+	var missing []string
+	if to == "" {
+		// Compare with current directory when no -to flag specified
+		toZipData, missing, err = getLocalZipDataForDiff(environ)
+		if err != nil {
+			return diff, err
+		}
+		diff.To = generateArchiveID(toZipData)
+		diff.Local = true
+	} else {
+		// Compare with another ref
+		toZipData, diff.To, err = getZipFromSource(environ, to)
+		if err != nil {
+			return diff, fmt.Errorf("failed to get 'to' source: %w", err)
+		}
+	}
+
+	// Use first 12 chars of archive IDs for brevity in diff output
+	diff.fromLabel = diff.From
+	if len(diff.fromLabel) > 12 {
+		diff.fromLabel = diff.fromLabel[:12]
+	}
+	diff.toLabel = diff.To
+	if diff.Local {
+		diff.toLabel += " (local)"
+	} else if len(diff.toLabel) > 12 {
+		diff.toLabel = diff.toLabel[:12]
+	}
+
+	options.formats = environ.Formats
+	if diff.Files, err = compareZips(fromZipData, toZipData, diff.fromLabel, diff.toLabel, options); err != nil {
+		return diff, err
+	}
+
+	// Tracked files missing locally are absent from the working files
+	for _, name := range missing {
+		i := sort.Search(len(diff.Files), func(i int) bool { return diff.Files[i].Name >= name })
+		if i < len(diff.Files) && diff.Files[i].Name == name {
+			diff.Files[i].Status = "missing"
+			continue
+		}
+		diff.Files = append(diff.Files, fileDiff{})
+		copy(diff.Files[i+1:], diff.Files[i:])
+		diff.Files[i] = fileDiff{Name: name, Status: "missing"}
+	}
+	return diff, nil
+}
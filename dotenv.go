@@ -0,0 +1,211 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var dotenvKey = regexp.MustCompile(`^\s*(?:export\s+)?([A-Za-z_][A-Za-z0-9_.-]*)\s*=`)
+
+// dotenvEntry is a logical line of a dotenv file. Key is empty for blank
+// lines and comments; Text spans several lines for multi-line quoted values.
+type dotenvEntry struct {
+	Key  string
+	Text string
+}
+
+// isDotenv recognises .env, .env.prod, prod.env and the like
+func isDotenv(name string) bool {
+	base := filepath.Base(name)
+	return base == ".env" || strings.HasPrefix(base, ".env.") || strings.HasSuffix(base, ".env")
+}
+
+// openQuote reports whether a value starts a quoted string it doesn't close
+func openQuote(value string) bool {
+	value = strings.TrimSpace(value)
+	if value == "" || (value[0] != '"' && value[0] != '\'') {
+		return false
+	}
+	quote := value[0]
+	for i := 1; i < len(value); i++ {
+		if value[i] == '\\' && quote == '"' {
+			i++
+			continue
+		}
+		if value[i] == quote {
+			return false
+		}
+	}
+	return true
+}
+
+func parseDotenv(content []byte) []dotenvEntry {
+	var entries []dotenvEntry
+	lines := splitLines(content)
+	for i := 0; i < len(lines); i++ {
+		match := dotenvKey.FindStringSubmatchIndex(lines[i])
+		if match == nil {
+			entries = append(entries, dotenvEntry{Text: lines[i]})
+			continue
+		}
+		key := lines[i][match[2]:match[3]]
+		text := lines[i]
+		if openQuote(lines[i][match[1]:]) {
+			for i+1 < len(lines) {
+				i++
+				text += "\n" + lines[i]
+				if !openQuote(text[match[1]:]) {
+					break
+				}
+			}
+		}
+		entries = append(entries, dotenvEntry{Key: key, Text: text})
+	}
+	return entries
+}
+
+// dotenvValues maps each key to its last definition
+func dotenvValues(entries []dotenvEntry) map[string]string {
+	values := make(map[string]string)
+	for _, entry := range entries {
+		if entry.Key != "" {
+			values[entry.Key] = entry.Text
+		}
+	}
+	return values
+}
+
+// dotenvValue is the value part of an entry's text, so that only value
+// changes count, not whitespace around the key or an added export
+func dotenvValue(text string) string {
+	match := dotenvKey.FindStringIndex(text)
+	if match == nil {
+		return text
+	}
+	return strings.TrimSpace(text[match[1]:])
+}
+
+// dotenvSide is the definition of a key on one side of a merge
+type dotenvSide struct {
+	text    string
+	present bool
+}
+
+func side(values map[string]string, key string) dotenvSide {
+	text, ok := values[key]
+	return dotenvSide{text: text, present: ok}
+}
+
+func conflictMarkers(ours, theirs dotenvSide, theirsLabel string) string {
+	var b strings.Builder
+	b.WriteString("<<<<<<< local\n")
+	if ours.present {
+		b.WriteString(ours.text + "\n")
+	}
+	b.WriteString("=======\n")
+	if theirs.present {
+		b.WriteString(theirs.text + "\n")
+	}
+	b.WriteString(">>>>>>> " + theirsLabel)
+	return b.String()
+}
+
+// mergeDotenv merges the key changes between base and theirs into ours, keeping
+// the layout and comments of ours. Keys changed differently on both sides are
+// returned as conflicts, and written with conflict markers if markers is set.
+func mergeDotenv(base, ours, theirs []byte, theirsLabel string, markers bool) ([]byte, []string) {
+	ourEntries := parseDotenv(ours)
+	theirEntries := parseDotenv(theirs)
+	baseValues := dotenvValues(parseDotenv(base))
+	ourValues := dotenvValues(ourEntries)
+	theirValues := dotenvValues(theirEntries)
+
+	resolved := make(map[string]dotenvSide)
+	conflicted := make(map[string]bool)
+	var conflicts []string
+	resolve := func(key string) {
+		if _, ok := resolved[key]; ok || conflicted[key] {
+			return
+		}
+		b, o, t := side(baseValues, key), side(ourValues, key), side(theirValues, key)
+		switch {
+		case o == t || t == b:
+			resolved[key] = o
+		case o == b:
+			resolved[key] = t
+		default:
+			conflicted[key] = true
+			conflicts = append(conflicts, key)
+		}
+	}
+
+	var lines []string
+	written := make(map[string]bool)
+	for _, entry := range ourEntries {
+		if entry.Key == "" {
+			lines = append(lines, entry.Text)
+			continue
+		}
+		resolve(entry.Key)
+		if written[entry.Key] {
+			continue
+		}
+		written[entry.Key] = true
+		if conflicted[entry.Key] {
+			if markers {
+				lines = append(lines, conflictMarkers(side(ourValues, entry.Key), side(theirValues, entry.Key), theirsLabel))
+			} else {
+				lines = append(lines, ourValues[entry.Key])
+			}
+		} else if r := resolved[entry.Key]; r.present {
+			lines = append(lines, r.text)
+		}
+	}
+	// Keys that are not in ours, in their order
+	for _, entry := range theirEntries {
+		if entry.Key == "" || written[entry.Key] {
+			continue
+		}
+		resolve(entry.Key)
+		written[entry.Key] = true
+		if conflicted[entry.Key] {
+			if markers {
+				lines = append(lines, conflictMarkers(dotenvSide{}, side(theirValues, entry.Key), theirsLabel))
+			}
+		} else if r := resolved[entry.Key]; r.present {
+			lines = append(lines, r.text)
+		}
+	}
+
+	sort.Strings(conflicts)
+	if len(lines) == 0 {
+		return nil, conflicts
+	}
+	return []byte(strings.Join(lines, "\n") + "\n"), conflicts
+}
+
+// mergeWithBase merges local edits to a dotenv file, made since the archive
+// baseID was synced, with its content in the archive theirsID
+func mergeWithBase(environ Environ, baseID, theirsID, name string, theirs []byte, markers bool) ([]byte, []string, error) {
+	// Never synced: keys on both sides with different values conflict
+	var base []byte
+	if baseID != "" {
+		baseZip, err := fetchArchive(environ, baseID)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to download base archive %s to merge %s: %w", baseID, name, err)
+		}
+		if base, err = zipFileContent(baseZip, name); err != nil {
+			return nil, nil, fmt.Errorf("failed to read %s from base archive %s: %w", name, baseID, err)
+		}
+	}
+	ours, err := os.ReadFile(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	merged, conflicts := mergeDotenv(base, ours, theirs, theirsID, markers)
+	return merged, conflicts, nil
+}
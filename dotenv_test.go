@@ -0,0 +1,49 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMergeDotenv(t *testing.T) {
+	base := []byte("# shared\nA=1\nB=2\nC=3\nD=4\n")
+	ours := []byte("# shared\nA=1\nB=local\nC=3\nD=local\nLOCAL=1\n")
+	theirs := []byte("# shared\nA=remote\nB=2\nD=remote\nREMOTE=1\n")
+
+	merged, conflicts := mergeDotenv(base, ours, theirs, "QlgiIViuR", false)
+	if !reflect.DeepEqual(conflicts, []string{"D"}) {
+		t.Fatalf("expected conflict on D, got %v", conflicts)
+	}
+	expected := "# shared\nA=remote\nB=local\nD=local\nLOCAL=1\nREMOTE=1\n"
+	if string(merged) != expected {
+		t.Fatalf("unexpected merge result:\n%s", merged)
+	}
+
+	merged, _ = mergeDotenv(base, ours, theirs, "QlgiIViuR", true)
+	expected = "# shared\nA=remote\nB=local\n<<<<<<< local\nD=local\n=======\nD=remote\n>>>>>>> QlgiIViuR\nLOCAL=1\nREMOTE=1\n"
+	if string(merged) != expected {
+		t.Fatalf("unexpected merge result with markers:\n%s", merged)
+	}
+}
+
+func TestParseDotenvMultilineValue(t *testing.T) {
+	entries := parseDotenv([]byte("export KEY=\"line1\nline2\"\nOTHER='x'\n"))
+	values := dotenvValues(entries)
+	if values["KEY"] != "export KEY=\"line1\nline2\"" || values["OTHER"] != "OTHER='x'" {
+		t.Fatalf("unexpected entries: %#v", entries)
+	}
+}
+
+func TestDotenvKeyChanges(t *testing.T) {
+	from := []byte("A=1\nB=2\n# C=3\n")
+	to := []byte("export A=1\nB=changed\nC=3\n")
+
+	changes, err := structuredChanges(formatDotenv, from, to)
+	if err != nil {
+		t.Fatalf("structuredChanges returned error: %v", err)
+	}
+	expected := []valueChange{{Op: "~", Path: "B", From: "2", To: "changed"}, {Op: "+", Path: "C", To: "3"}}
+	if !reflect.DeepEqual(changes, expected) {
+		t.Fatalf("expected %v, got %v", expected, changes)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+
+	"go.starlark.net/starlark"
+)
+
+const envelopeAlgorithm = "AES-256-GCM"
+
+var envelopeHeader = []byte("environ-envelope-v1\n")
+
+// envelope is stored as a single JSON line between envelopeHeader and the ciphertext
+type envelope struct {
+	Algorithm  string `json:"alg"`
+	Provider   string `json:"provider"`
+	KeyID      string `json:"key_id"`
+	WrappedKey []byte `json:"wrapped_key"`
+}
+
+func encrypted(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var of Remote
+	var key KeyProvider
+	allowPlaintext := false
+	if err := starlark.UnpackArgs(fn.Name(), args, kwargs, "of", &of, "key", &key, "allow_plaintext?", &allowPlaintext); err != nil {
+		return nil, err
+	}
+	return Encrypted{
+		Of:             of,
+		Key:            key,
+		allowPlaintext: allowPlaintext,
+	}, nil
+}
+
+// Encrypted encrypts each archive with a random data key, wrapped by Key and
+// stored next to the ciphertext so the underlying remote sees opaque bytes
+type Encrypted struct {
+	Of             Remote
+	Key            KeyProvider
+	allowPlaintext bool
+}
+
+func (e Encrypted) seal(value []byte) ([]byte, error) {
+	dataKey := make([]byte, keySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+	wrapped, keyID, err := e.Key.WrapKey(dataKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to wrap data key with %s: %w", e.Key, err)
+	}
+	header, err := json.Marshal(envelope{
+		Algorithm:  envelopeAlgorithm,
+		Provider:   e.Key.Type(),
+		KeyID:      keyID,
+		WrappedKey: wrapped,
+	})
+	if err != nil {
+		return nil, err
+	}
+	ciphertext, err := sealAESGCM(dataKey, value, header)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	buf.Write(envelopeHeader)
+	buf.Write(header)
+	buf.WriteByte('\n')
+	buf.Write(ciphertext)
+	return buf.Bytes(), nil
+}
+
+func (e Encrypted) open(content []byte) ([]byte, error) {
+	header, ciphertext, ok := bytes.Cut(content[len(envelopeHeader):], []byte("\n"))
+	if !ok {
+		return nil, fmt.Errorf("truncated envelope header")
+	}
+	var env envelope
+	if err := json.Unmarshal(header, &env); err != nil {
+		return nil, fmt.Errorf("invalid envelope header: %w", err)
+	}
+	if env.Algorithm != envelopeAlgorithm {
+		return nil, fmt.Errorf("unsupported algorithm %q", env.Algorithm)
+	}
+	if env.Provider != e.Key.Type() {
+		return nil, fmt.Errorf("data key was wrapped by a %s provider, but %s is configured", env.Provider, e.Key)
+	}
+	dataKey, err := e.Key.UnwrapKey(env.WrappedKey, env.KeyID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap data key: %w", err)
+	}
+	return openAESGCM(dataKey, ciphertext, header)
+}
+
+func (e Encrypted) Get(key string) ([]byte, error) {
+	content, err := e.Of.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(content, envelopeHeader) {
+		if plaintext, ok, err := readPlaintext(key, content, e.Of, e.allowPlaintext); ok {
+			return plaintext, err
+		}
+		return nil, fmt.Errorf("archive %s is neither encrypted nor a ZIP", key)
+	}
+	plaintext, err := e.open(content)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt archive %s: %w", key, err)
+	}
+	return plaintext, nil
+}
+
+func (e Encrypted) Write(key string, value []byte) error {
+	sealed, err := e.seal(value)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt archive %s: %w", key, err)
+	}
+	return e.Of.Write(key, sealed)
+}
+
+func (e Encrypted) Overwrite(key string, value []byte) error {
+	sealed, err := e.seal(value)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt archive %s: %w", key, err)
+	}
+	return overwrite(e.Of, key, sealed)
+}
+
+func (e Encrypted) Unwrap() []Remote {
+	return []Remote{e.Of}
+}
+
+func (e Encrypted) String() string {
+	return fmt.Sprintf("encrypted(%s, %s)", e.Of, e.Key)
+}
+
+func (e Encrypted) Type() string {
+	return "Encrypted"
+}
+
+func (e Encrypted) Freeze() {
+}
+
+func (e Encrypted) Truth() starlark.Bool {
+	return starlark.Bool(true)
+}
+
+func (e Encrypted) Hash() (uint32, error) {
+	return starlark.String(e.String()).Hash()
+}
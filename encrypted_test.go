@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeTestKey(t *testing.T, path string) {
+	t.Helper()
+	key := make([]byte, keySize)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	if err := os.WriteFile(path, []byte(base64.StdEncoding.EncodeToString(key)+"\n"), 0600); err != nil {
+		t.Fatalf("failed to write key: %v", err)
+	}
+}
+
+func TestEncryptedSurvivesKeyRotation(t *testing.T) {
+	dir := t.TempDir()
+	oldKey := filepath.Join(dir, "kek.old")
+	newKey := filepath.Join(dir, "kek")
+	writeTestKey(t, oldKey)
+	writeTestKey(t, newKey)
+
+	inner := memoryRemote{}
+	archive := zipData(t, map[string]string{".env": "SECRET=value\n"})
+
+	before := Encrypted{Of: inner, Key: FileKey{path: oldKey}}
+	if err := before.Write("key", archive); err != nil {
+		t.Fatalf("Write returned error: %v", err)
+	}
+	if bytes.Contains(inner["key"], []byte("SECRET=value")) {
+		t.Fatalf("expected stored archive to be encrypted")
+	}
+
+	after := Encrypted{Of: inner, Key: FileKey{path: newKey, previous: []string{oldKey}}}
+	decrypted, err := after.Get("key")
+	if err != nil {
+		t.Fatalf("Get after rotation returned error: %v", err)
+	}
+	if !bytes.Equal(decrypted, archive) {
+		t.Fatalf("decrypted archive does not match original")
+	}
+
+	// A deleted key earlier in the list doesn't stop the search
+	missingFirst := Encrypted{Of: inner, Key: FileKey{path: newKey, previous: []string{filepath.Join(dir, "deleted"), oldKey}}}
+	if _, err := missingFirst.Get("key"); err != nil {
+		t.Fatalf("Get with an unreadable previous key returned error: %v", err)
+	}
+
+	withoutOld := Encrypted{Of: inner, Key: FileKey{path: newKey}}
+	if _, err := withoutOld.Get("key"); err == nil {
+		t.Fatalf("expected Get to fail without the previous key")
+	}
+}
+
+func TestEncryptedRejectsPlaintextArchives(t *testing.T) {
+	inner := memoryRemote{"key": zipData(t, map[string]string{".env": "SECRET=planted\n"})}
+	remote := Encrypted{Of: inner, Key: FileKey{path: filepath.Join(t.TempDir(), "kek")}}
+
+	var plaintext PlaintextArchive
+	if _, err := remote.Get("key"); !errors.As(err, &plaintext) {
+		t.Fatalf("expected PlaintextArchive, got %v", err)
+	}
+	remote.allowPlaintext = true
+	if _, err := remote.Get("key"); err != nil {
+		t.Fatalf("expected plaintext archive with allow_plaintext, got %v", err)
+	}
+}
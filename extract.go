@@ -0,0 +1,153 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// Secrets files are small, anything bigger is likely a ZIP bomb
+	maxEntrySize   = 16 << 20
+	maxArchiveSize = 64 << 20
+)
+
+// validateEntryName rejects entry names that are not relative paths inside
+// the working directory. Names are cleaned first, since configs may list
+// files as ./.env.
+func validateEntryName(name string) error {
+	if name == "" || strings.ContainsAny(name, "\\\x00") || path.IsAbs(name) || filepath.IsAbs(name) || filepath.VolumeName(name) != "" {
+		return fmt.Errorf("unsafe path %q in ZIP", name)
+	}
+	cleaned := path.Clean(name)
+	if cleaned == "." {
+		return fmt.Errorf("unsafe path %q in ZIP", name)
+	}
+	for _, part := range strings.Split(cleaned, "/") {
+		if part == ".." {
+			return fmt.Errorf("unsafe path %q in ZIP", name)
+		}
+	}
+	return nil
+}
+
+// validateZip checks entry names and declared sizes before anything is extracted.
+// archive/zip fails reads whose actual size differs from the declared one.
+func validateZip(zipReader *zip.Reader) error {
+	seen := make(map[string]bool)
+	var total uint64
+	for _, file := range zipReader.File {
+		if err := validateEntryName(file.Name); err != nil {
+			return err
+		}
+		// ./.env and .env are the same file
+		if seen[path.Clean(file.Name)] {
+			return fmt.Errorf("duplicate entry %q in ZIP", file.Name)
+		}
+		seen[path.Clean(file.Name)] = true
+		if file.UncompressedSize64 > maxEntrySize {
+			return fmt.Errorf("entry %q in ZIP is larger than %d bytes", file.Name, maxEntrySize)
+		}
+		total += file.UncompressedSize64
+		if total > maxArchiveSize {
+			return fmt.Errorf("ZIP is larger than %d bytes uncompressed", maxArchiveSize)
+		}
+	}
+	return nil
+}
+
+func readZipFileContent(file *zip.File) ([]byte, error) {
+	reader, err := file.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	content, err := io.ReadAll(io.LimitReader(reader, maxEntrySize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(content) > maxEntrySize {
+		return nil, fmt.Errorf("entry %q in ZIP is larger than %d bytes", file.Name, maxEntrySize)
+	}
+	return content, nil
+}
+
+// zipFileContent reads a single file from an archive, which is empty if the file is absent
+func zipFileContent(zipData []byte, name string) ([]byte, error) {
+	zipReader, err := zip.NewReader(bytes.NewReader(zipData), int64(len(zipData)))
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range zipReader.File {
+		if file.Name == name {
+			return readZipFileContent(file)
+		}
+	}
+	return nil, nil
+}
+
+// createZipEntry adds an entry for a file, recording the environ's mode rather
+// than the local permissions, so that archive IDs don't depend on umask
+func createZipEntry(zipWriter *zip.Writer, file string, mode os.FileMode) (io.Writer, error) {
+	header := &zip.FileHeader{
+		Name:   file,
+		Method: zip.Deflate,
+	}
+	header.SetMode(mode)
+	return zipWriter.CreateHeader(header)
+}
+
+// entryMode is the mode to restore an entry with, capped by mode. Entries
+// pushed before modes were recorded read as 0666.
+func entryMode(file *zip.File, mode os.FileMode) os.FileMode {
+	return file.Mode().Perm() & mode
+}
+
+// tightenMode removes the permissions beyond mode from an existing file
+func tightenMode(name string, mode os.FileMode) (bool, error) {
+	info, err := os.Stat(name)
+	if err != nil {
+		return false, err
+	}
+	if info.Mode().Perm()&^mode == 0 {
+		return false, nil
+	}
+	return true, os.Chmod(name, info.Mode().Perm()&mode)
+}
+
+// checkWritablePath refuses names whose existing parent directories, or the
+// file itself, are symlinks resolving outside root
+func checkWritablePath(root, name string) error {
+	resolvedRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return err
+	}
+	current := root
+	for _, part := range strings.Split(name, "/") {
+		current = filepath.Join(current, part)
+		info, err := os.Lstat(current)
+		if os.IsNotExist(err) {
+			// Created by us from here on
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			continue
+		}
+		target, err := filepath.EvalSymlinks(current)
+		if err != nil {
+			return fmt.Errorf("failed to resolve symlink %s: %w", current, err)
+		}
+		if rel, err := filepath.Rel(resolvedRoot, target); err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+			return fmt.Errorf("refusing to write %s through symlink %s to %s outside %s", name, current, target, root)
+		}
+	}
+	return nil
+}
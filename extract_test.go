@@ -0,0 +1,113 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type zipEntry struct {
+	name    string
+	content string
+	// size overrides the uncompressed size declared in the header
+	size uint64
+}
+
+// craftedZip writes entries in order, allowing names and sizes zip.Writer.Create would normalise
+func craftedZip(t *testing.T, entries ...zipEntry) *zip.Reader {
+	t.Helper()
+	var buf bytes.Buffer
+	zipWriter := zip.NewWriter(&buf)
+	for _, entry := range entries {
+		size := entry.size
+		if size == 0 {
+			size = uint64(len(entry.content))
+		}
+		writer, err := zipWriter.CreateRaw(&zip.FileHeader{
+			Name:               entry.name,
+			Method:             zip.Store,
+			CompressedSize64:   uint64(len(entry.content)),
+			UncompressedSize64: size,
+		})
+		if err != nil {
+			t.Fatalf("failed to create zip entry %s: %v", entry.name, err)
+		}
+		if _, err := writer.Write([]byte(entry.content)); err != nil {
+			t.Fatalf("failed to write zip entry %s: %v", entry.name, err)
+		}
+	}
+	if err := zipWriter.Close(); err != nil {
+		t.Fatalf("failed to close zip writer: %v", err)
+	}
+	zipReader, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("failed to read crafted zip: %v", err)
+	}
+	return zipReader
+}
+
+func TestValidateZipRejectsUnsafeArchives(t *testing.T) {
+	cases := map[string][]zipEntry{
+		"parent traversal":  {{name: "../.env", content: "X=1"}},
+		"nested traversal":  {{name: "agent/../../.env", content: "X=1"}},
+		"absolute path":     {{name: "/etc/passwd", content: "X=1"}},
+		"backslash":         {{name: "..\\.env", content: "X=1"}},
+		"duplicate entries": {{name: ".env", content: "X=1"}, {name: ".env", content: "X=2"}},
+		"oversized entry":   {{name: ".env", content: "X=1", size: maxEntrySize + 1}},
+		"oversized archive": {{name: "a", size: maxEntrySize}, {name: "b", size: maxEntrySize}, {name: "c", size: maxEntrySize}, {name: "d", size: maxEntrySize}, {name: "e", size: 1}},
+		"empty name":        {{name: "", content: "X=1"}},
+		"duplicate cleaned": {{name: ".env", content: "X=1"}, {name: "./.env", content: "X=2"}},
+		"current dir":       {{name: "agent/..", content: "X=1"}},
+	}
+	for name, entries := range cases {
+		if err := validateZip(craftedZip(t, entries...)); err == nil {
+			t.Errorf("%s: expected validateZip to fail", name)
+		}
+	}
+
+	// Names from configs listing ./.env still pull
+	valid := craftedZip(t, zipEntry{name: "./.env", content: "X=1"}, zipEntry{name: "agent/.env.prod", content: "Y=2"}, zipEntry{name: "agent//.env.dev", content: "Z=3"})
+	if err := validateZip(valid); err != nil {
+		t.Fatalf("expected valid ZIP to pass, got %v", err)
+	}
+}
+
+func TestReadZipFileContentEnforcesDeclaredSize(t *testing.T) {
+	zipReader := craftedZip(t, zipEntry{name: ".env", content: strings.Repeat("X", 64), size: 8})
+	if _, err := readZipFileContent(zipReader.File[0]); err == nil {
+		t.Fatalf("expected reading past the declared size to fail")
+	}
+}
+
+func TestCheckWritablePathRejectsSymlinksOutsideRoot(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	if err := os.Symlink(outside, filepath.Join(root, "escape")); err != nil {
+		t.Fatalf("failed to create symlink: %v", err)
+	}
+	if err := os.Mkdir(filepath.Join(root, "inside"), 0755); err != nil {
+		t.Fatalf("failed to create directory: %v", err)
+	}
+	if err := os.Symlink(filepath.Join(root, "inside"), filepath.Join(root, "alias")); err != nil {
+		t.Fatalf("failed to create symlink: %v", err)
+	}
+	if err := os.Symlink(filepath.Join(outside, "target"), filepath.Join(root, ".env")); err != nil {
+		t.Fatalf("failed to create symlink: %v", err)
+	}
+
+	if err := checkWritablePath(root, "escape/.env"); err == nil {
+		t.Errorf("expected write through directory symlink outside root to fail")
+	}
+	if err := checkWritablePath(root, ".env"); err == nil {
+		t.Errorf("expected write through file symlink outside root to fail")
+	}
+	if err := checkWritablePath(root, "alias/.env"); err != nil {
+		t.Errorf("expected write through symlink inside root to pass, got %v", err)
+	}
+	if err := checkWritablePath(root, "new/dir/.env"); err != nil {
+		t.Errorf("expected write to new directories to pass, got %v", err)
+	}
+}
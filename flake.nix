@@ -17,7 +17,7 @@
             pname = "environ";
             version = "0.2.0";
             src = ./.;
-            vendorHash = "sha256-CWAkfjgO8wmXfTPpwqBGcW2HEX62vOUfE+UCuzkZmbg=";
+            vendorHash = "sha256-f7/7100rGfOJy+os34gQ00WGYffRpDU7SkUu9/1BhjU=";
           };
         }
     );
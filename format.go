@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	ctyjson "github.com/zclconf/go-cty/cty/json"
+	"go.starlark.net/starlark"
+	"gopkg.in/yaml.v3"
+)
+
+// Formats that files can be diffed as, key by key rather than line by line
+const (
+	formatText   = "text"
+	formatDotenv = "dotenv"
+	formatJSON   = "json"
+	formatYAML   = "yaml"
+	formatTfvars = "tfvars"
+)
+
+var formats = []string{formatText, formatDotenv, formatJSON, formatYAML, formatTfvars}
+
+func file(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var path, format string
+	if err := starlark.UnpackArgs(fn.Name(), args, kwargs, "path", &path, "format?", &format); err != nil {
+		return nil, err
+	}
+	if format != "" && !isFormat(format) {
+		return nil, fmt.Errorf("%s: unknown format %q, expected one of %s", fn.Name(), format, strings.Join(formats, ", "))
+	}
+	return File{Path: path, Format: format}, nil
+}
+
+// File is an entry of an environ's files with options
+type File struct {
+	Path string
+	// Format overrides the format guessed from the file name
+	Format string
+}
+
+func (f File) String() string {
+	return fmt.Sprintf("file(%s)", f.Path)
+}
+
+func (f File) Type() string {
+	return "File"
+}
+
+func (f File) Freeze() {
+}
+
+func (f File) Truth() starlark.Bool {
+	return starlark.Bool(true)
+}
+
+func (f File) Hash() (uint32, error) {
+	return starlark.String(f.Path).Hash()
+}
+
+func isFormat(format string) bool {
+	for _, f := range formats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+// fileFormat is the format of a file, from formats or else its name. Formats
+// only matter to -keys in diff and log, and to dotenv merges in pull.
+func fileFormat(name string, formats map[string]string) string {
+	if format, ok := formats[name]; ok {
+		return format
+	}
+	switch {
+	case isDotenv(name):
+		return formatDotenv
+	case strings.HasSuffix(name, ".tfvars"):
+		// Not .hcl, whose blocks tfvars parsing rejects
+		return formatTfvars
+	}
+	switch filepath.Ext(name) {
+	case ".json":
+		return formatJSON
+	case ".yaml", ".yml":
+		return formatYAML
+	}
+	return formatText
+}
+
+// valueChange is a key or path added (+), removed (-) or changed (~)
+type valueChange struct {
+	Op   string `json:"op"`
+	Path string `json:"path"`
+	From string `json:"-"`
+	To   string `json:"-"`
+}
+
+// structuredChanges lists the keys or paths that differ between two versions
+// of a file, sorted by path. from or to is nil if the file is only on one side.
+func structuredChanges(format string, from, to []byte) ([]valueChange, error) {
+	fromValues, err := structuredValues(format, from)
+	if err != nil {
+		return nil, err
+	}
+	toValues, err := structuredValues(format, to)
+	if err != nil {
+		return nil, err
+	}
+	var changes []valueChange
+	for path, fromValue := range fromValues {
+		if toValue, ok := toValues[path]; !ok {
+			changes = append(changes, valueChange{Op: "-", Path: path, From: fromValue})
+		} else if toValue != fromValue {
+			changes = append(changes, valueChange{Op: "~", Path: path, From: fromValue, To: toValue})
+		}
+	}
+	for path, toValue := range toValues {
+		if _, ok := fromValues[path]; !ok {
+			changes = append(changes, valueChange{Op: "+", Path: path, To: toValue})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Path < changes[j].Path })
+	return changes, nil
+}
+
+// structuredValues flattens a file to the value at each key or path
+func structuredValues(format string, content []byte) (map[string]string, error) {
+	values := make(map[string]string)
+	if content == nil {
+		return values, nil
+	}
+	var tree any
+	switch format {
+	case formatDotenv:
+		for key, text := range dotenvValues(parseDotenv(content)) {
+			values[key] = dotenvValue(text)
+		}
+		return values, nil
+	case formatJSON:
+		decoder := json.NewDecoder(bytes.NewReader(content))
+		decoder.UseNumber()
+		if err := decoder.Decode(&tree); err != nil {
+			return nil, fmt.Errorf("failed to parse JSON: %w", err)
+		}
+	case formatYAML:
+		if err := yaml.Unmarshal(content, &tree); err != nil {
+			return nil, fmt.Errorf("failed to parse YAML: %w", err)
+		}
+	case formatTfvars:
+		var err error
+		if tree, err = parseTfvars(content); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("format %s has no keys", format)
+	}
+	flatten("", tree, values)
+	return values, nil
+}
+
+// parseTfvars evaluates the attributes of a tfvars file, which can't refer
+// to variables or functions
+func parseTfvars(content []byte) (map[string]any, error) {
+	file, diags := hclsyntax.ParseConfig(content, "tfvars", hcl.InitialPos)
+	if diags.HasErrors() {
+		return nil, fmt.Errorf("failed to parse tfvars: %w", diags)
+	}
+	attributes, diags := file.Body.JustAttributes()
+	if diags.HasErrors() {
+		return nil, fmt.Errorf("failed to parse tfvars: %w", diags)
+	}
+	tree := make(map[string]any)
+	for name, attribute := range attributes {
+		value, diags := attribute.Expr.Value(nil)
+		if diags.HasErrors() {
+			return nil, fmt.Errorf("failed to evaluate %s: %w", name, diags)
+		}
+		encoded, err := ctyjson.Marshal(value, value.Type())
+		if err != nil {
+			return nil, fmt.Errorf("failed to convert %s: %w", name, err)
+		}
+		decoder := json.NewDecoder(bytes.NewReader(encoded))
+		decoder.UseNumber()
+		var decoded any
+		if err := decoder.Decode(&decoded); err != nil {
+			return nil, fmt.Errorf("failed to convert %s: %w", name, err)
+		}
+		tree[name] = decoded
+	}
+	return tree, nil
+}
+
+var identifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_-]*$`)
+
+// flatten records the scalar at each path of tree, like db.password or
+// services[2].token, and empty maps and lists as {} and []
+func flatten(path string, tree any, values map[string]string) {
+	name := path
+	if name == "" {
+		name = "(root)"
+	}
+	child := func(key string) string {
+		if !identifier.MatchString(key) {
+			encoded, _ := json.Marshal(key)
+			return path + "[" + string(encoded) + "]"
+		}
+		if path == "" {
+			return key
+		}
+		return path + "." + key
+	}
+	switch node := tree.(type) {
+	case map[string]any:
+		if len(node) == 0 {
+			values[name] = "{}"
+		}
+		for key, value := range node {
+			flatten(child(key), value, values)
+		}
+	case map[any]any:
+		if len(node) == 0 {
+			values[name] = "{}"
+		}
+		for key, value := range node {
+			flatten(child(fmt.Sprint(key)), value, values)
+		}
+	case []any:
+		if len(node) == 0 {
+			values[name] = "[]"
+		}
+		for i, value := range node {
+			flatten(fmt.Sprintf("%s[%d]", path, i), value, values)
+		}
+	default:
+		encoded, err := json.Marshal(node)
+		if err != nil {
+			encoded = []byte(fmt.Sprint(node))
+		}
+		values[name] = string(encoded)
+	}
+}
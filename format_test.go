@@ -0,0 +1,53 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestStructuredChangesIgnoreKeyOrder(t *testing.T) {
+	for _, test := range []struct {
+		format   string
+		from, to string
+	}{
+		{formatJSON,
+			`{"db": {"password": "old", "host": "db"}, "services": [{"token": "a"}, {"token": "b"}, {"token": "c"}]}`,
+			`{"services": [{"token": "a"}, {"token": "b"}, {"token": "new"}], "db": {"host": "db", "password": "new"}, "debug": true}`},
+		{formatYAML,
+			"db:\n  password: old\n  host: db\nservices:\n  - token: a\n  - token: b\n  - token: c\n",
+			"debug: true\nservices:\n  - token: a\n  - token: b\n  - token: new\ndb:\n  host: db\n  password: new\n"},
+		{formatTfvars,
+			"db = {\n  password = \"old\"\n  host = \"db\"\n}\nservices = [{ token = \"a\" }, { token = \"b\" }, { token = \"c\" }]\n",
+			"debug = true\nservices = [{ token = \"a\" }, { token = \"b\" }, { token = \"new\" }]\ndb = {\n  host = \"db\"\n  password = \"new\"\n}\n"},
+	} {
+		changes, err := structuredChanges(test.format, []byte(test.from), []byte(test.to))
+		if err != nil {
+			t.Fatalf("structuredChanges(%s) returned error: %v", test.format, err)
+		}
+		var paths []string
+		for _, change := range changes {
+			paths = append(paths, change.Op+" "+change.Path)
+		}
+		expected := []string{"~ db.password", "+ debug", "~ services[2].token"}
+		if !reflect.DeepEqual(paths, expected) {
+			t.Fatalf("expected %s changes %v, got %v", test.format, expected, paths)
+		}
+	}
+}
+
+func TestFileFormat(t *testing.T) {
+	formats := map[string]string{"config/secrets": formatYAML}
+	for name, expected := range map[string]string{
+		"frontend/.env.prod":         formatDotenv,
+		"tofu/prod/terraform.tfvars": formatTfvars,
+		"tofu/prod/terragrunt.hcl":   formatText,
+		"config/app.json":            formatJSON,
+		"config/app.yml":             formatYAML,
+		"config/secrets":             formatYAML,
+		"certs/server.pem":           formatText,
+	} {
+		if format := fileFormat(name, formats); format != expected {
+			t.Fatalf("expected %s to be %s, got %s", name, expected, format)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"strings"
@@ -49,6 +50,14 @@ func (g GCS) Get(key string) ([]byte, error) {
 	return body, nil
 }
 
+func (g GCS) Exists(key string) (bool, error) {
+	_, err := g.client.Bucket(g.bucket).Object(g.prefix + "/" + key).Attrs(context.Background())
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
 func realWriteError(err error) bool {
 	return err != nil && !strings.Contains(err.Error(), "conditionNotMet")
 }
@@ -65,6 +74,15 @@ func (g GCS) Write(key string, value []byte) error {
 	return nil
 }
 
+func (g GCS) Overwrite(key string, value []byte) error {
+	writer := g.client.Bucket(g.bucket).Object(g.prefix + "/" + key).NewWriter(context.Background())
+	if _, err := writer.Write(value); err != nil {
+		writer.Close()
+		return err
+	}
+	return writer.Close()
+}
+
 func (g GCS) String() string {
 	return fmt.Sprintf("gcs(%s, %s)", g.bucket, g.prefix)
 }
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"sort"
+	"strings"
+
+	"go.starlark.net/starlark"
+)
+
+// GitNotFound is returned by Git.Get when the key is in neither the local nor the fetched ref
+type GitNotFound struct {
+	ref string
+	key string
+}
+
+func (e GitNotFound) Error() string {
+	return fmt.Sprintf("%s not found in %s", e.key, e.ref)
+}
+
+func gitNotFound(ref, key string) GitNotFound {
+	return GitNotFound{ref: ref, key: key}
+}
+
+func gitfunc(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	repo := "."
+	ref := "refs/environ/archives"
+	remote := "origin"
+	if err := starlark.UnpackArgs(fn.Name(), args, kwargs, "repo?", &repo, "ref?", &ref, "remote?", &remote); err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(ref, "refs/") {
+		return nil, fmt.Errorf("%s: ref %q does not start with refs/", fn.Name(), ref)
+	}
+	return Git{
+		repo:   expandHome(repo),
+		ref:    ref,
+		remote: remote,
+	}, nil
+}
+
+// Git stores archives as blobs in the tree of a dedicated ref, one commit per
+// write. The ref is pushed to and fetched from remote, unless remote is empty.
+type Git struct {
+	repo   string
+	ref    string
+	remote string
+}
+
+func (g Git) git(args ...string) (string, error) {
+	return runGit(append([]string{"-C", g.repo}, args...)...)
+}
+
+// revision returns the commit the ref points to, or "" if it doesn't exist
+func (g Git) revision(ref string) string {
+	out, err := g.git("rev-parse", "--verify", "--quiet", ref+"^{commit}")
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(out)
+}
+
+func (g Git) has(key string) bool {
+	_, err := g.git("cat-file", "-e", g.ref+":"+key)
+	return err == nil
+}
+
+// entries lists the tree of a commit as ls-tree lines by name
+func (g Git) entries(commit string) (map[string]string, error) {
+	entries := make(map[string]string)
+	if commit == "" {
+		return entries, nil
+	}
+	out, err := g.git("ls-tree", commit)
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		if _, name, ok := strings.Cut(line, "\t"); ok {
+			entries[name] = line
+		}
+	}
+	return entries, nil
+}
+
+// commit records entries on top of parents and moves the ref from the first
+// parent, failing if the ref moved in the meantime
+func (g Git) commit(entries map[string]string, message string, parents ...string) error {
+	lines := make([]string, 0, len(entries))
+	for _, line := range entries {
+		lines = append(lines, line)
+	}
+	sort.Strings(lines)
+	tree, err := runGitWithInput([]byte(strings.Join(lines, "\n")+"\n"), "-C", g.repo, "mktree")
+	if err != nil {
+		return err
+	}
+	args := []string{"commit-tree", strings.TrimSpace(tree), "-m", message}
+	for _, parent := range parents {
+		if parent != "" {
+			args = append(args, "-p", parent)
+		}
+	}
+	commit, err := g.git(args...)
+	if err != nil {
+		return err
+	}
+	// An empty old value means the ref must not exist yet
+	_, err = g.git("update-ref", g.ref, strings.TrimSpace(commit), parents[0])
+	return err
+}
+
+// fetch merges the remote ref into the local one. Writes only add entries,
+// so the merge is the union of both trees, except that entries replaced on
+// one side since the merge base win, with the fetched side winning ties.
+func (g Git) fetch() error {
+	if g.remote == "" {
+		return nil
+	}
+	if _, err := g.git("ls-remote", "--quiet", "--exit-code", g.remote, g.ref); err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && exitErr.ExitCode() == 2 {
+			// Nothing pushed yet
+			return nil
+		}
+		return err
+	}
+	if _, err := g.git("fetch", "--quiet", g.remote, g.ref); err != nil {
+		return err
+	}
+	fetched := g.revision("FETCH_HEAD")
+	local := g.revision(g.ref)
+	if local == "" || local == fetched {
+		_, err := g.git("update-ref", g.ref, fetched, local)
+		return err
+	}
+	if _, err := g.git("merge-base", "--is-ancestor", fetched, local); err == nil {
+		return nil
+	}
+	if _, err := g.git("merge-base", "--is-ancestor", local, fetched); err == nil {
+		_, err := g.git("update-ref", g.ref, fetched, local)
+		return err
+	}
+	// Without a common history, there's no base: all local entries are kept
+	base, _ := g.git("merge-base", local, fetched)
+	baseEntries, err := g.entries(strings.TrimSpace(base))
+	if err != nil {
+		return err
+	}
+	entries, err := g.entries(fetched)
+	if err != nil {
+		return err
+	}
+	localEntries, err := g.entries(local)
+	if err != nil {
+		return err
+	}
+	for name, line := range localEntries {
+		// Keep what was added or overwritten here, unless overwritten there,
+		// so as not to undo a rekey pushed from another clone
+		if line != baseEntries[name] && entries[name] == baseEntries[name] {
+			entries[name] = line
+		}
+	}
+	return g.commit(entries, "Merge archives from "+g.remote, local, fetched)
+}
+
+// push publishes the ref, merging in what others pushed when it is rejected
+func (g Git) push() error {
+	if g.remote == "" {
+		return nil
+	}
+	var err error
+	for attempt := 0; attempt < 3; attempt++ {
+		if _, err = g.git("push", "--quiet", g.remote, g.ref+":"+g.ref); err == nil {
+			return nil
+		}
+		if fetchErr := g.fetch(); fetchErr != nil {
+			return fmt.Errorf("%w, and failed to fetch: %w", err, fetchErr)
+		}
+	}
+	return err
+}
+
+func (g Git) Get(key string) ([]byte, error) {
+	if !g.has(key) {
+		if err := g.fetch(); err != nil {
+			return []byte{}, fmt.Errorf("failed to fetch %s from %s: %w", g.ref, g.remote, err)
+		}
+		if !g.has(key) {
+			return []byte{}, gitNotFound(g.ref, key)
+		}
+	}
+	out, err := g.git("cat-file", "blob", g.ref+":"+key)
+	if err != nil {
+		return []byte{}, err
+	}
+	return []byte(out), nil
+}
+
+func (g Git) Exists(key string) (bool, error) {
+	if g.has(key) {
+		return true, nil
+	}
+	if err := g.fetch(); err != nil {
+		return false, fmt.Errorf("failed to fetch %s from %s: %w", g.ref, g.remote, err)
+	}
+	return g.has(key), nil
+}
+
+func (g Git) put(key string, value []byte, replace bool) error {
+	if key == "" || strings.Contains(key, "/") {
+		return fmt.Errorf("invalid key %q for %s", key, g)
+	}
+	blob, err := runGitWithInput(value, "-C", g.repo, "hash-object", "-w", "--stdin")
+	if err != nil {
+		return err
+	}
+	entry := "100644 blob " + strings.TrimSpace(blob) + "\t" + key
+	for attempt := 0; ; attempt++ {
+		parent := g.revision(g.ref)
+		entries, err := g.entries(parent)
+		if err != nil {
+			return err
+		}
+		if _, ok := entries[key]; ok && !replace {
+			// Already there
+			break
+		}
+		entries[key] = entry
+		err = g.commit(entries, "Add "+key, parent)
+		if err == nil {
+			break
+		}
+		if attempt == 2 {
+			return err
+		}
+	}
+	return g.push()
+}
+
+func (g Git) Write(key string, value []byte) error {
+	return g.put(key, value, false)
+}
+
+// Overwrite commits value over the existing entry; earlier values stay in
+// the history of the ref, and of the remote's, until the ref is recreated
+func (g Git) Overwrite(key string, value []byte) error {
+	return g.put(key, value, true)
+}
+
+func (g Git) String() string {
+	return fmt.Sprintf("git(%s, %s)", g.repo, g.ref)
+}
+
+func (g Git) Type() string {
+	return "Git"
+}
+
+func (g Git) Freeze() {
+}
+
+func (g Git) Truth() starlark.Bool {
+	return starlark.Bool(true)
+}
+
+func (g Git) Hash() (uint32, error) {
+	return starlark.String(g.String()).Hash()
+}
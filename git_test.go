@@ -0,0 +1,83 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// gitClones returns two clones of an empty bare repository
+func gitClones(t *testing.T) (string, string) {
+	t.Helper()
+	t.Setenv("GIT_AUTHOR_NAME", "test")
+	t.Setenv("GIT_AUTHOR_EMAIL", "test@example.com")
+	t.Setenv("GIT_COMMITTER_NAME", "test")
+	t.Setenv("GIT_COMMITTER_EMAIL", "test@example.com")
+	dir := t.TempDir()
+	server := filepath.Join(dir, "server.git")
+	if _, err := runGit("init", "-q", "--bare", server); err != nil {
+		t.Skipf("git is not available: %v", err)
+	}
+	a, b := filepath.Join(dir, "a"), filepath.Join(dir, "b")
+	for _, clone := range []string{a, b} {
+		if _, err := runGit("clone", "-q", server, clone); err != nil {
+			t.Fatalf("failed to clone: %v", err)
+		}
+	}
+	return a, b
+}
+
+func TestGitGetFetchesMissingKeys(t *testing.T) {
+	a, b := gitClones(t)
+	remoteA := Git{repo: a, ref: "refs/environ/archives", remote: "origin"}
+	remoteB := Git{repo: b, ref: "refs/environ/archives", remote: "origin"}
+
+	if _, err := remoteB.Get("missing"); !isNotFound(err) {
+		t.Fatalf("expected not found before anything was pushed, got %v", err)
+	}
+	if err := remoteA.Write("from-a", []byte("a")); err != nil {
+		t.Fatalf("Write returned error: %v", err)
+	}
+	// b hasn't fetched a's archive, so its push is rejected and merged
+	if err := remoteB.Write("from-b", []byte("b")); err != nil {
+		t.Fatalf("Write after a concurrent push returned error: %v", err)
+	}
+
+	for key, want := range map[string]string{"from-a": "a", "from-b": "b"} {
+		content, err := remoteA.Get(key)
+		if err != nil || string(content) != want {
+			t.Fatalf("expected %q for %s, got %q (%v)", want, key, content, err)
+		}
+	}
+	if _, err := remoteA.Get("missing"); !isNotFound(err) {
+		t.Fatalf("expected not found, got %v", err)
+	}
+}
+
+func TestGitFetchKeepsOverwritesFromOtherClones(t *testing.T) {
+	a, b := gitClones(t)
+	remoteA := Git{repo: a, ref: "refs/environ/archives", remote: "origin"}
+	remoteB := Git{repo: b, ref: "refs/environ/archives", remote: "origin"}
+
+	if err := remoteA.Write("id", []byte("old key")); err != nil {
+		t.Fatalf("Write returned error: %v", err)
+	}
+	if content, err := remoteB.Get("id"); err != nil || string(content) != "old key" {
+		t.Fatalf("expected b to fetch the archive, got %q (%v)", content, err)
+	}
+	// A rekey on a, then a push from b that hasn't fetched it
+	if err := remoteA.Overwrite("id", []byte("new key")); err != nil {
+		t.Fatalf("Overwrite returned error: %v", err)
+	}
+	if err := remoteB.Write("other", []byte("b")); err != nil {
+		t.Fatalf("Write after a concurrent overwrite returned error: %v", err)
+	}
+
+	for _, remote := range []Git{remoteA, remoteB} {
+		if err := remote.fetch(); err != nil {
+			t.Fatalf("fetch returned error: %v", err)
+		}
+		if content, err := remote.Get("id"); err != nil || string(content) != "new key" {
+			t.Fatalf("expected the overwrite to survive the merge in %s, got %q (%v)", remote.repo, content, err)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// runGit runs git in the current directory and returns its standard output
+func runGit(args ...string) (string, error) {
+	return runGitWithInput(nil, args...)
+}
+
+// runGitWithInput runs git with input on its standard input
+func runGitWithInput(input []byte, args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	if input != nil {
+		cmd.Stdin = bytes.NewReader(input)
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("git %s: %w: %s", strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return string(out), nil
+}
+
+// refAtRevision reads the archive ID stored in the ref file at a git revision
+func refAtRevision(revision, ref string) (string, error) {
+	// A revision starting with - must not be taken for an option
+	content, err := runGit("show", "--end-of-options", revision+":./"+ref)
+	if err != nil {
+		return "", err
+	}
+	archiveID := strings.TrimSpace(content)
+	if !isArchiveID(archiveID) {
+		return "", fmt.Errorf("ref file %s at %s does not contain an archive ID", ref, revision)
+	}
+	return archiveID, nil
+}
+
+// refHistory lists the distinct archive IDs the ref file pointed to in any
+// commit reachable from a git ref, most recent first
+func refHistory(ref string) ([]string, error) {
+	out, err := runGit("log", "--all", "--format=%H", "--", ref)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	var archiveIDs []string
+	for _, commit := range strings.Fields(out) {
+		archiveID, err := refAtRevision(commit, ref)
+		if err != nil {
+			// The ref file was deleted in this commit
+			continue
+		}
+		if !seen[archiveID] {
+			seen[archiveID] = true
+			archiveIDs = append(archiveIDs, archiveID)
+		}
+	}
+	return archiveIDs, nil
+}
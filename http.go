@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"go.starlark.net/starlark"
+)
+
+// HTTPNotFound is returned by the HTTP and Vault remotes when the server answers 404
+type HTTPNotFound struct {
+	url string
+}
+
+func (e HTTPNotFound) Error() string {
+	return fmt.Sprintf("%s not found", e.url)
+}
+
+func httpNotFound(url string) HTTPNotFound {
+	return HTTPNotFound{url: url}
+}
+
+func httpfunc(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var baseURL, tokenEnv, tokenFile, username, passwordEnv, passwordFile string
+	var headers *starlark.Dict
+	if err := starlark.UnpackArgs(fn.Name(), args, kwargs, "url", &baseURL, "headers?", &headers, "token_env?", &tokenEnv, "token_file?", &tokenFile, "username?", &username, "password_env?", &passwordEnv, "password_file?", &passwordFile); err != nil {
+		return nil, err
+	}
+	if _, err := url.Parse(baseURL); err != nil {
+		return nil, fmt.Errorf("%s: %w", fn.Name(), err)
+	}
+	if (tokenEnv != "" || tokenFile != "") && username != "" {
+		return nil, fmt.Errorf("%s: use either a token or a username, not both", fn.Name())
+	}
+	if username == "" && (passwordEnv != "" || passwordFile != "") {
+		return nil, fmt.Errorf("%s: a password needs a username", fn.Name())
+	}
+	h := HTTP{
+		url:          strings.TrimSuffix(baseURL, "/"),
+		headers:      map[string]string{},
+		tokenEnv:     tokenEnv,
+		tokenFile:    expandHome(tokenFile),
+		username:     username,
+		passwordEnv:  passwordEnv,
+		passwordFile: expandHome(passwordFile),
+		client:       &http.Client{Timeout: time.Minute},
+	}
+	if headers != nil {
+		for _, item := range headers.Items() {
+			name, ok := item[0].(starlark.String)
+			value, ok2 := item[1].(starlark.String)
+			if !ok || !ok2 {
+				return nil, fmt.Errorf("%s: header %s is not a string to string", fn.Name(), item[0])
+			}
+			h.headers[name.GoString()] = value.GoString()
+		}
+	}
+	return h, nil
+}
+
+// HTTP stores archives on any server that supports GET and PUT, such as a WebDAV share
+type HTTP struct {
+	url     string
+	headers map[string]string
+	// Bearer token, or password for basic auth, read from an env var or a file on each request
+	tokenEnv, tokenFile                 string
+	username, passwordEnv, passwordFile string
+	client                              *http.Client
+}
+
+// secret reads a credential from an env var or a file
+func secret(env, file string) (string, error) {
+	if env != "" {
+		value, ok := os.LookupEnv(env)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", env)
+		}
+		return value, nil
+	}
+	if file != "" {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(content)), nil
+	}
+	return "", nil
+}
+
+func (h HTTP) request(method, key string, body []byte) (*http.Request, error) {
+	request, err := http.NewRequest(method, h.url+"/"+url.PathEscape(key), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range h.headers {
+		request.Header.Set(name, value)
+	}
+	if h.tokenEnv != "" || h.tokenFile != "" {
+		token, err := secret(h.tokenEnv, h.tokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read token: %w", err)
+		}
+		request.Header.Set("Authorization", "Bearer "+token)
+	} else if h.username != "" {
+		password, err := secret(h.passwordEnv, h.passwordFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read password: %w", err)
+		}
+		request.SetBasicAuth(h.username, password)
+	}
+	return request, nil
+}
+
+func (h HTTP) Get(key string) ([]byte, error) {
+	request, err := h.request(http.MethodGet, key, nil)
+	if err != nil {
+		return []byte{}, err
+	}
+	resp, err := h.client.Do(request)
+	if err != nil {
+		return []byte{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return []byte{}, httpNotFound(request.URL.Redacted())
+	}
+	if resp.StatusCode != http.StatusOK {
+		return []byte{}, fmt.Errorf("GET %s: %s", request.URL.Redacted(), resp.Status)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return []byte{}, err
+	}
+	return body, nil
+}
+
+func (h HTTP) Exists(key string) (bool, error) {
+	request, err := h.request(http.MethodHead, key, nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := h.client.Do(request)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	case http.StatusMethodNotAllowed, http.StatusNotImplemented:
+		// Some servers only support GET
+		_, err := h.Get(key)
+		if isNotFound(err) {
+			return false, nil
+		}
+		return err == nil, err
+	}
+	return false, fmt.Errorf("HEAD %s: %s", request.URL.Redacted(), resp.Status)
+}
+
+func (h HTTP) put(key string, value []byte, createOnly bool) error {
+	request, err := h.request(http.MethodPut, key, value)
+	if err != nil {
+		return err
+	}
+	if createOnly {
+		request.Header.Set("If-None-Match", "*")
+	}
+	resp, err := h.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil
+	case createOnly && resp.StatusCode == http.StatusPreconditionFailed:
+		// Already there
+		return nil
+	default:
+		return fmt.Errorf("PUT %s: %s", request.URL.Redacted(), resp.Status)
+	}
+}
+
+func (h HTTP) Write(key string, value []byte) error {
+	return h.put(key, value, true)
+}
+
+func (h HTTP) Overwrite(key string, value []byte) error {
+	return h.put(key, value, false)
+}
+
+func (h HTTP) String() string {
+	return fmt.Sprintf("http(%s)", h.url)
+}
+
+func (h HTTP) Type() string {
+	return "HTTP"
+}
+
+func (h HTTP) Freeze() {
+}
+
+func (h HTTP) Truth() starlark.Bool {
+	return starlark.Bool(true)
+}
+
+func (h HTTP) Hash() (uint32, error) {
+	return starlark.String(h.String()).Hash()
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// fakeServer stores PUT bodies and serves them back, honouring If-None-Match: *
+// and answering HEAD
+func fakeServer(t *testing.T, authorization string) (*httptest.Server, map[string][]byte) {
+	t.Helper()
+	var mu sync.Mutex
+	objects := make(map[string][]byte)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != authorization {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.Method {
+		case http.MethodGet, http.MethodHead:
+			content, ok := objects[r.URL.Path]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Write(content)
+		case http.MethodPut:
+			if _, ok := objects[r.URL.Path]; ok && r.Header.Get("If-None-Match") == "*" {
+				w.WriteHeader(http.StatusPreconditionFailed)
+				return
+			}
+			content, _ := io.ReadAll(r.Body)
+			objects[r.URL.Path] = content
+			w.WriteHeader(http.StatusCreated)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server, objects
+}
+
+func TestHTTPGetMapsNotFound(t *testing.T) {
+	server, _ := fakeServer(t, "")
+	remote := HTTP{url: server.URL, client: server.Client()}
+
+	var notFound HTTPNotFound
+	if _, err := remote.Get("missing"); !errors.As(err, &notFound) {
+		t.Fatalf("expected HTTPNotFound, got %v", err)
+	}
+
+	server.Close()
+	if _, err := remote.Get("missing"); err == nil || isNotFound(err) {
+		t.Fatalf("expected a connection error distinct from not found, got %v", err)
+	}
+}
+
+func TestHTTPAuth(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("s3cret\n"), 0600); err != nil {
+		t.Fatalf("failed to write token: %v", err)
+	}
+	server, _ := fakeServer(t, "Bearer s3cret")
+	remote := HTTP{url: server.URL, tokenFile: tokenFile, client: server.Client()}
+	if err := remote.Write("id", []byte("content")); err != nil {
+		t.Fatalf("Write with bearer token returned error: %v", err)
+	}
+
+	t.Setenv("TEST_HTTP_PASSWORD", "hunter2")
+	server, _ = fakeServer(t, "Basic dXNlcjpodW50ZXIy")
+	remote = HTTP{url: server.URL, username: "user", passwordEnv: "TEST_HTTP_PASSWORD", client: server.Client()}
+	if err := remote.Write("id", []byte("content")); err != nil {
+		t.Fatalf("Write with basic auth returned error: %v", err)
+	}
+
+	remote.passwordEnv = "TEST_HTTP_UNSET"
+	if err := remote.Write("id", []byte("content")); err == nil {
+		t.Fatalf("expected an error for an unset password variable")
+	}
+}
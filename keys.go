@@ -0,0 +1,196 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"go.starlark.net/starlark"
+)
+
+// AES-256 keys are 32 bytes
+const keySize = 32
+
+// KeyProvider wraps and unwraps the per-archive data keys used by Encrypted.
+// Implementations may hold several key-encryption keys so that old archives
+// stay readable after a rotation.
+type KeyProvider interface {
+	starlark.Value
+	// WrapKey encrypts dataKey with the current key-encryption key and returns its ID
+	WrapKey(dataKey []byte) (wrapped []byte, keyID string, err error)
+	// UnwrapKey decrypts a data key that was wrapped by the key-encryption key keyID
+	UnwrapKey(wrapped []byte, keyID string) ([]byte, error)
+}
+
+// sealAESGCM encrypts plaintext with AES-256-GCM, prepending the random nonce
+func sealAESGCM(key, plaintext, additionalData []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+// openAESGCM decrypts the output of sealAESGCM
+func openAESGCM(key, ciphertext, additionalData []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < gcm.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	nonce, sealed := ciphertext[:gcm.NonceSize()], ciphertext[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, sealed, additionalData)
+}
+
+// readKeyFile reads a base64-encoded 32-byte key
+func readKeyFile(path string) ([]byte, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key file: %w", err)
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(content)))
+	if err != nil || len(key) != keySize {
+		return nil, fmt.Errorf("key file %s must contain %d base64-encoded bytes", path, keySize)
+	}
+	return key, nil
+}
+
+// loadOrCreateKeyFile reads a key file, generating it with 0600 permissions on first use
+func loadOrCreateKeyFile(path string) ([]byte, error) {
+	key, err := readKeyFile(path)
+	if !errors.Is(err, fs.ErrNotExist) {
+		return key, err
+	}
+	key = make([]byte, keySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create directory for key file: %w", err)
+	}
+	// O_EXCL so that concurrent first uses agree on a single key
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if errors.Is(err, fs.ErrExist) {
+		return readKeyFile(path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create key file: %w", err)
+	}
+	_, err = file.WriteString(base64.StdEncoding.EncodeToString(key) + "\n")
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to write key file %s: %w", path, err)
+	}
+	return key, nil
+}
+
+// keyID identifies a key without revealing it
+func keyID(key []byte) string {
+	hash := sha256.Sum256(key)
+	return hex.EncodeToString(hash[:8])
+}
+
+func fileKey(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	path := ""
+	var previous *starlark.List
+	if err := starlark.UnpackArgs(fn.Name(), args, kwargs, "path", &path, "previous?", &previous); err != nil {
+		return nil, err
+	}
+	var previousPaths []string
+	if previous != nil {
+		for i := 0; i < previous.Len(); i++ {
+			s, ok := previous.Index(i).(starlark.String)
+			if !ok {
+				return nil, fmt.Errorf("%s: previous key %s is not a string", fn.Name(), previous.Index(i))
+			}
+			previousPaths = append(previousPaths, expandHome(s.GoString()))
+		}
+	}
+	return FileKey{
+		path:     expandHome(path),
+		previous: previousPaths,
+	}, nil
+}
+
+// FileKey wraps data keys with a key-encryption key read from a local file.
+// Keys listed in previous are only used to unwrap, which allows rotating the
+// key-encryption key without rewriting existing archives.
+type FileKey struct {
+	path     string
+	previous []string
+}
+
+func (f FileKey) WrapKey(dataKey []byte) ([]byte, string, error) {
+	kek, err := readKeyFile(f.path)
+	if err != nil {
+		return nil, "", err
+	}
+	wrapped, err := sealAESGCM(kek, dataKey, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	return wrapped, keyID(kek), nil
+}
+
+func (f FileKey) UnwrapKey(wrapped []byte, id string) ([]byte, error) {
+	// An unreadable key, e.g. a retired one that was deleted, must not hide the others
+	var readErrors []error
+	for _, path := range append([]string{f.path}, f.previous...) {
+		kek, err := readKeyFile(path)
+		if err != nil {
+			readErrors = append(readErrors, err)
+			continue
+		}
+		if keyID(kek) == id {
+			return openAESGCM(kek, wrapped, nil)
+		}
+	}
+	if len(readErrors) > 0 {
+		return nil, fmt.Errorf("no key with ID %s in %s: %w", id, f, errors.Join(readErrors...))
+	}
+	return nil, fmt.Errorf("no key with ID %s in %s", id, f)
+}
+
+func (f FileKey) String() string {
+	return fmt.Sprintf("file_key(%s)", f.path)
+}
+
+func (f FileKey) Type() string {
+	return "FileKey"
+}
+
+func (f FileKey) Freeze() {
+}
+
+func (f FileKey) Truth() starlark.Bool {
+	return starlark.Bool(true)
+}
+
+func (f FileKey) Hash() (uint32, error) {
+	return starlark.String(f.String()).Hash()
+}
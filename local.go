@@ -1,7 +1,9 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
+	"log"
 	"os"
 	"path/filepath"
 	"strings"
@@ -9,32 +11,163 @@ import (
 	"go.starlark.net/starlark"
 )
 
+const defaultLocalKey = "~/.config/environ/local.key"
+
+var localHeader = []byte("environ-local-v1\n")
+
 func local(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
 	path := ""
-	if err := starlark.UnpackArgs(fn.Name(), args, kwargs, "path", &path); err != nil {
+	encrypt := false
+	key := ""
+	if err := starlark.UnpackArgs(fn.Name(), args, kwargs, "path", &path, "encrypt?", &encrypt, "key?", &key); err != nil {
 		return nil, err
 	}
-	if strings.HasPrefix(path, "~/") {
-		path = filepath.Join(os.Getenv("HOME"), path[2:])
+	if key == "" {
+		key = defaultLocalKey
 	}
+	path = expandHome(path)
 	if err := os.MkdirAll(path, 0700); err != nil {
 		return nil, fmt.Errorf("failed to create directory %s: %w", path, err)
 	}
 	return Local{
-		path: path,
+		path:    path,
+		encrypt: encrypt,
+		key:     expandHome(key),
 	}, nil
 }
 
+// expandHome resolves a leading ~/ to the user's home directory
+func expandHome(path string) string {
+	if strings.HasPrefix(path, "~/") {
+		return filepath.Join(os.Getenv("HOME"), path[2:])
+	}
+	return path
+}
+
+// Local stores archives as files in a directory. With encrypt, files are
+// encrypted at rest with a per-machine key, created on first use; encrypted
+// and plaintext files can be read either way.
 type Local struct {
-	path string
+	path    string
+	encrypt bool
+	key     string
+}
+
+func (l Local) seal(key string, value []byte) ([]byte, error) {
+	machineKey, err := loadOrCreateKeyFile(l.key)
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := sealAESGCM(machineKey, value, []byte(key))
+	if err != nil {
+		return nil, err
+	}
+	return append(append([]byte{}, localHeader...), sealed...), nil
 }
 
 func (l Local) Get(key string) ([]byte, error) {
-	return os.ReadFile(filepath.Join(l.path, key))
+	content, err := os.ReadFile(filepath.Join(l.path, key))
+	if err != nil || !bytes.HasPrefix(content, localHeader) {
+		return content, err
+	}
+	machineKey, err := readKeyFile(l.key)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := openAESGCM(machineKey, content[len(localHeader):], []byte(key))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt %s with %s: %w", key, l.key, err)
+	}
+	return plaintext, nil
+}
+
+func (l Local) Exists(key string) (bool, error) {
+	_, err := os.Stat(filepath.Join(l.path, key))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
 }
 
 func (l Local) Write(key string, value []byte) error {
-	return os.WriteFile(filepath.Join(l.path, key), value, 0644)
+	if l.encrypt {
+		sealed, err := l.seal(key, value)
+		if err != nil {
+			return fmt.Errorf("failed to encrypt %s: %w", key, err)
+		}
+		value = sealed
+	}
+	return os.WriteFile(filepath.Join(l.path, key), value, 0600)
+}
+
+func (l Local) Overwrite(key string, value []byte) error {
+	return l.Write(key, value)
+}
+
+// migrate encrypts the plaintext files left from before encryption was enabled
+func (l Local) migrate() (int, error) {
+	if !l.encrypt {
+		return 0, nil
+	}
+	entries, err := os.ReadDir(l.path)
+	if err != nil {
+		return 0, err
+	}
+	migrated := 0
+	for _, entry := range entries {
+		// Leftover temporary files and anything else in the directory are not ours
+		if !entry.Type().IsRegular() || !isArchiveID(entry.Name()) {
+			continue
+		}
+		path := filepath.Join(l.path, entry.Name())
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return migrated, err
+		}
+		if bytes.HasPrefix(content, localHeader) {
+			continue
+		}
+		sealed, err := l.seal(entry.Name(), content)
+		if err != nil {
+			return migrated, fmt.Errorf("failed to encrypt %s: %w", entry.Name(), err)
+		}
+		// Write next to the original and rename, so a failure never loses the entry
+		tmp := path + ".tmp"
+		if err := os.WriteFile(tmp, sealed, 0600); err != nil {
+			return migrated, err
+		}
+		if err := os.Rename(tmp, path); err != nil {
+			os.Remove(tmp)
+			return migrated, err
+		}
+		migrated++
+	}
+	return migrated, nil
+}
+
+func migrateCacheAll(environNames []string) error {
+	for _, environName := range environNames {
+		environ, ok := environs[environName]
+		if !ok {
+			return envNotFound(environName)
+		}
+		var err error
+		walkRemotes(environ.Remote, func(remote Remote) {
+			l, ok := remote.(Local)
+			if !ok || err != nil {
+				return
+			}
+			var migrated int
+			migrated, err = l.migrate()
+			if migrated > 0 {
+				log.Printf("Encrypted %d plaintext entries in %s", migrated, l)
+			}
+		})
+		if err != nil {
+			return fmt.Errorf("failed to migrate %s: %w", environName, err)
+		}
+	}
+	return nil
 }
 
 func (l Local) String() string {
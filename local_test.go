@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLocalEncryptionAndMigration(t *testing.T) {
+	dir := t.TempDir()
+	plain := Local{path: dir, key: filepath.Join(dir, "keys", "local.key")}
+	encrypted := plain
+	encrypted.encrypt = true
+
+	archive := zipData(t, map[string]string{".env": "SECRET=value\n"})
+	legacy := generateArchiveID(archive)
+	fresh := generateArchiveID([]byte("fresh"))
+	if err := plain.Write(legacy, archive); err != nil {
+		t.Fatalf("Write returned error: %v", err)
+	}
+	if err := encrypted.Write(fresh, archive); err != nil {
+		t.Fatalf("Write returned error: %v", err)
+	}
+	if err := plain.Write(legacy+".tmp-1234", archive); err != nil {
+		t.Fatalf("Write returned error: %v", err)
+	}
+
+	info, err := os.Stat(encrypted.key)
+	if err != nil {
+		t.Fatalf("expected key file to be created: %v", err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Fatalf("expected key file mode 0600, got %v", info.Mode().Perm())
+	}
+
+	for _, key := range []string{legacy, fresh} {
+		content, err := encrypted.Get(key)
+		if err != nil {
+			t.Fatalf("Get(%s) returned error: %v", key, err)
+		}
+		if !bytes.Equal(content, archive) {
+			t.Fatalf("Get(%s) does not match original", key)
+		}
+	}
+
+	migrated, err := encrypted.migrate()
+	if err != nil {
+		t.Fatalf("migrate returned error: %v", err)
+	}
+	if migrated != 1 {
+		t.Fatalf("expected 1 migrated entry, got %d", migrated)
+	}
+	raw, err := os.ReadFile(filepath.Join(dir, legacy))
+	if err != nil {
+		t.Fatalf("failed to read migrated entry: %v", err)
+	}
+	if !bytes.HasPrefix(raw, localHeader) {
+		t.Fatalf("expected legacy entry to be encrypted after migration")
+	}
+	if raw, _ := os.ReadFile(filepath.Join(dir, legacy+".tmp-1234")); !bytes.Equal(raw, archive) {
+		t.Fatalf("expected files that are not archives to be left alone")
+	}
+}
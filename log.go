@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// refCommit is a commit that changed the ref file of an environ
+type refCommit struct {
+	Hash      string
+	Author    string
+	Date      string
+	ArchiveID string
+	// PreviousArchiveID is the archive ID in the first parent, since the
+	// next commit listed may be on a merged branch
+	PreviousArchiveID string
+}
+
+// refCommits lists the commits of the current branch that changed the ref
+// file, most recent first. Commits that deleted it have an empty ArchiveID,
+// as do root commits for PreviousArchiveID.
+func refCommits(ref string) ([]refCommit, error) {
+	out, err := runGit("log", "--format=%H%x00%an <%ae>%x00%ad", "--", ref)
+	if err != nil {
+		return nil, err
+	}
+	var commits []refCommit
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		fields := strings.SplitN(line, "\x00", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		commit := refCommit{Hash: fields[0], Author: fields[1], Date: fields[2]}
+		// The ref file was deleted in this commit if it can't be read
+		commit.ArchiveID, _ = refAtRevision(commit.Hash, ref)
+		commit.PreviousArchiveID, _ = refAtRevision(commit.Hash+"^", ref)
+		commits = append(commits, commit)
+	}
+	return commits, nil
+}
+
+// fileChange is how a file differs between two archives
+type fileChange struct {
+	Name string
+	// Status is added, removed or modified
+	Status string
+	// Keys changed, for files with a structured format
+	Keys []valueChange
+	// KeysErr is why the keys could not be compared
+	KeysErr error
+}
+
+// archiveChanges compares the files of two archives
+func archiveChanges(from, to map[string][]byte, formats map[string]string) []fileChange {
+	var changes []fileChange
+	add := func(name, status string, fromContent, toContent []byte) {
+		change := fileChange{Name: name, Status: status}
+		if format := fileFormat(name, formats); format != formatText {
+			change.Keys, change.KeysErr = structuredChanges(format, fromContent, toContent)
+		}
+		changes = append(changes, change)
+	}
+	for name, toContent := range to {
+		fromContent, ok := from[name]
+		if !ok {
+			add(name, "added", nil, toContent)
+		} else if !bytes.Equal(fromContent, toContent) {
+			add(name, "modified", fromContent, toContent)
+		}
+	}
+	for name, fromContent := range from {
+		if _, ok := to[name]; !ok {
+			add(name, "removed", fromContent, nil)
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Name < changes[j].Name })
+	return changes
+}
+
+// logEnviron prints the commits that changed the ref of an environ, with the
+// files each one changed and, if keys is set, the keys
+func logEnviron(environ Environ, keys bool) error {
+	commits, err := refCommits(environ.Ref)
+	if err != nil {
+		return err
+	}
+
+	archives := make(map[string]map[string][]byte)
+	contents := func(archiveID string) (map[string][]byte, error) {
+		if archiveID == "" {
+			return map[string][]byte{}, nil
+		}
+		if files, ok := archives[archiveID]; ok {
+			return files, nil
+		}
+		zipData, err := fetchArchive(environ, archiveID)
+		if err != nil {
+			return nil, err
+		}
+		files, err := zipContents(zipData)
+		if err != nil {
+			return nil, err
+		}
+		archives[archiveID] = files
+		return files, nil
+	}
+
+	for _, commit := range commits {
+		fmt.Printf("commit %s\n", commit.Hash)
+		fmt.Printf("Author:  %s\n", commit.Author)
+		fmt.Printf("Date:    %s\n", commit.Date)
+		if commit.ArchiveID == "" {
+			fmt.Printf("Archive: none (%s deleted)\n\n", environ.Ref)
+			continue
+		}
+		fmt.Printf("Archive: %s\n\n", commit.ArchiveID)
+
+		previousID := commit.PreviousArchiveID
+		to, err := contents(commit.ArchiveID)
+		if err != nil {
+			fmt.Printf("    archive unavailable: %s\n\n", err)
+			continue
+		}
+		from, err := contents(previousID)
+		if err != nil {
+			fmt.Printf("    previous archive %s unavailable: %s\n\n", previousID, err)
+			continue
+		}
+
+		changes := archiveChanges(from, to, environ.Formats)
+		if len(changes) == 0 {
+			fmt.Printf("    no file changes\n")
+		}
+		for _, change := range changes {
+			fmt.Printf("    %-8s %s\n", change.Status, change.Name)
+			if !keys {
+				continue
+			}
+			if change.KeysErr != nil {
+				fmt.Printf("        keys unavailable: %s\n", change.KeysErr)
+			}
+			for _, key := range change.Keys {
+				fmt.Printf("        %s %s\n", key.Op, key.Path)
+			}
+		}
+		fmt.Println()
+	}
+	return nil
+}
+
+func logAll(environNames []string, keys bool) error {
+	for _, environName := range environNames {
+		environ, ok := environs[environName]
+		if !ok {
+			return envNotFound(environName)
+		}
+		if len(environNames) > 1 {
+			fmt.Printf("=== %s\n\n", environName)
+		}
+		if err := logEnviron(environ, keys); err != nil {
+			return fmt.Errorf("failed to log %s: %w", environName, err)
+		}
+	}
+	return nil
+}
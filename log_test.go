@@ -0,0 +1,72 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRefCommitsComparesWithFirstParent(t *testing.T) {
+	t.Chdir(t.TempDir())
+	initGitRepo(t)
+	ids := make(map[string]string)
+	for _, name := range []string{"a", "b", "c", "d"} {
+		ids[name] = generateArchiveID([]byte(name))
+	}
+	// Commit dates order the log as merge, feature, main, root
+	commitAt := func(date, content string) {
+		t.Helper()
+		t.Setenv("GIT_AUTHOR_DATE", date)
+		t.Setenv("GIT_COMMITTER_DATE", date)
+		commitFile(t, "environ.hash", content+"\n")
+	}
+	commitAt("2024-01-01T00:00:00Z", ids["a"])
+	if _, err := runGit("branch", "feature"); err != nil {
+		t.Fatalf("git branch failed: %v", err)
+	}
+	commitAt("2024-01-02T00:00:00Z", ids["c"])
+	if _, err := runGit("checkout", "-q", "feature"); err != nil {
+		t.Fatalf("git checkout failed: %v", err)
+	}
+	commitAt("2024-01-03T00:00:00Z", ids["b"])
+	if _, err := runGit("checkout", "-q", "-"); err != nil {
+		t.Fatalf("git checkout failed: %v", err)
+	}
+	if _, err := runGit("merge", "-q", "--no-commit", "-s", "ours", "feature"); err != nil {
+		t.Fatalf("git merge failed: %v", err)
+	}
+	commitAt("2024-01-04T00:00:00Z", ids["d"])
+
+	commits, err := refCommits("environ.hash")
+	if err != nil {
+		t.Fatalf("refCommits returned error: %v", err)
+	}
+	var got [][2]string
+	for _, commit := range commits {
+		got = append(got, [2]string{commit.ArchiveID, commit.PreviousArchiveID})
+	}
+	expected := [][2]string{{ids["d"], ids["c"]}, {ids["b"], ids["a"]}, {ids["c"], ids["a"]}, {ids["a"], ""}}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected archive and previous archive IDs %v, got %v", expected, got)
+	}
+}
+
+func TestArchiveChanges(t *testing.T) {
+	from := map[string][]byte{".env": []byte("A=1\nB=2\n"), "old.txt": []byte("old"), "same.txt": []byte("same")}
+	to := map[string][]byte{".env": []byte("A=1\nB=3\nC=4\n"), "new.txt": []byte("new"), "same.txt": []byte("same")}
+
+	changes := archiveChanges(from, to, nil)
+	var statuses []string
+	for _, change := range changes {
+		statuses = append(statuses, change.Status+" "+change.Name)
+	}
+	if !reflect.DeepEqual(statuses, []string{"modified .env", "added new.txt", "removed old.txt"}) {
+		t.Fatalf("unexpected changes %v", statuses)
+	}
+	var keys []string
+	for _, key := range changes[0].Keys {
+		keys = append(keys, key.Op+" "+key.Path)
+	}
+	if changes[0].KeysErr != nil || !reflect.DeepEqual(keys, []string{"~ B", "+ C"}) {
+		t.Fatalf("unexpected key changes %v (%v)", keys, changes[0].KeysErr)
+	}
+}
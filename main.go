@@ -3,19 +3,18 @@ package main
 import (
 	"archive/zip"
 	"bytes"
+	"crypto/ed25519"
 	"crypto/sha256"
 	"encoding/base64"
 	"errors"
 	"flag"
 	"fmt"
-	"io"
 	"log"
 	"os"
 	"path/filepath"
 	"sort"
 	"strings"
 
-	"github.com/peter-evans/patience"
 	"go.starlark.net/starlark"
 	"go.starlark.net/syntax"
 )
@@ -23,6 +22,8 @@ import (
 const (
 	// SHA256 produces 32-byte hashes
 	sha256HashSize = 32
+	// Secrets are only readable by their owner unless environ.star says otherwise
+	defaultMode = 0600
 )
 
 type EnvNotFound struct {
@@ -37,10 +38,29 @@ func envNotFound(name string) EnvNotFound {
 	return EnvNotFound{name: name}
 }
 
+// ArchiveHashMismatch is returned when downloaded content does not hash to its archive ID
+type ArchiveHashMismatch struct {
+	archiveID string
+	actual    string
+}
+
+func (e ArchiveHashMismatch) Error() string {
+	return fmt.Sprintf("archive %s is corrupted or tampered with: its content hashes to %s", e.archiveID, e.actual)
+}
+
+func archiveHashMismatch(archiveID, actual string) ArchiveHashMismatch {
+	return ArchiveHashMismatch{archiveID: archiveID, actual: actual}
+}
+
 type Environ struct {
 	Remote
-	Files []string
-	Ref   string
+	Name           string
+	Files          []string
+	Formats        map[string]string
+	Ref            string
+	Mode           os.FileMode
+	SigningKey     string
+	TrustedSigners []ed25519.PublicKey
 }
 
 type Remote interface {
@@ -54,6 +74,41 @@ type Remote interface {
 	Hash() (uint32, error)
 }
 
+// Overwriter is implemented by remotes that can replace an existing object,
+// which Write never does since archives are content-addressed
+type Overwriter interface {
+	Overwrite(key string, value []byte) error
+}
+
+// Exister is implemented by remotes that can tell whether an object exists
+// without downloading it
+type Exister interface {
+	Exists(key string) (bool, error)
+}
+
+// wrapper is implemented by remotes that delegate to other remotes
+type wrapper interface {
+	Unwrap() []Remote
+}
+
+// walkRemotes calls fn on remote and every remote it wraps
+func walkRemotes(remote Remote, fn func(Remote)) {
+	fn(remote)
+	if w, ok := remote.(wrapper); ok {
+		for _, inner := range w.Unwrap() {
+			walkRemotes(inner, fn)
+		}
+	}
+}
+
+func overwrite(remote Remote, key string, value []byte) error {
+	overwriter, ok := remote.(Overwriter)
+	if !ok {
+		return fmt.Errorf("remote %s does not support overwriting", remote)
+	}
+	return overwriter.Overwrite(key, value)
+}
+
 var (
 	opts = syntax.FileOptions{
 		Set:             true,
@@ -66,16 +121,48 @@ var (
 )
 
 func environ(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
-	var name, ref string
+	var name, ref, signingKey string
 	var remote Remote
-	var files *starlark.List
+	var files, trustedSigners *starlark.List
+	mode := defaultMode
 
-	if err := starlark.UnpackArgs(fn.Name(), args, kwargs, "name", &name, "remote", &remote, "files", &files, "ref", &ref); err != nil {
+	if err := starlark.UnpackArgs(fn.Name(), args, kwargs, "name", &name, "remote", &remote, "files", &files, "ref", &ref, "mode?", &mode, "signing_key?", &signingKey, "trusted_signers?", &trustedSigners); err != nil {
 		return nil, err
 	}
+	if mode <= 0 || mode > 0777 {
+		return nil, fmt.Errorf("%s: mode %#o is not a permission mode", fn.Name(), mode)
+	}
 	var fileList []string = make([]string, files.Len())
+	fileFormats := make(map[string]string)
 	for i := 0; i < files.Len(); i++ {
-		fileList[i] = files.Index(i).(starlark.String).GoString()
+		switch f := files.Index(i).(type) {
+		case starlark.String:
+			fileList[i] = f.GoString()
+		case File:
+			fileList[i] = f.Path
+			if f.Format != "" {
+				fileFormats[f.Path] = f.Format
+			}
+		default:
+			return nil, fmt.Errorf("%s: file %s is neither a string nor a file()", fn.Name(), f)
+		}
+	}
+	var signers []ed25519.PublicKey
+	if trustedSigners != nil {
+		for i := 0; i < trustedSigners.Len(); i++ {
+			s, ok := trustedSigners.Index(i).(starlark.String)
+			if !ok {
+				return nil, fmt.Errorf("%s: trusted signer %s is not a string", fn.Name(), trustedSigners.Index(i))
+			}
+			publicKey, err := parsePublicKey(s.GoString())
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", fn.Name(), err)
+			}
+			signers = append(signers, publicKey)
+		}
+	}
+	if signingKey != "" {
+		signingKey = expandHome(signingKey)
 	}
 
 	if _, ok := environs[name]; ok {
@@ -83,9 +170,14 @@ func environ(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple,
 	}
 
 	environs[name] = Environ{
-		Remote: remote,
-		Files:  fileList,
-		Ref:    ref,
+		Remote:         remote,
+		Name:           name,
+		Files:          fileList,
+		Formats:        fileFormats,
+		Ref:            ref,
+		Mode:           os.FileMode(mode),
+		SigningKey:     signingKey,
+		TrustedSigners: signers,
 	}
 	return starlark.None, nil
 }
@@ -101,7 +193,17 @@ func fileHasChanged(filename string, newContent []byte) (bool, error) {
 	return !bytes.Equal(existingContent, newContent), nil
 }
 
-func pull(environ Environ) error {
+// pullOptions control how pull treats files modified since the last sync
+type pullOptions struct {
+	// force overwrites them
+	force bool
+	// markers writes conflict markers for dotenv keys changed on both sides
+	markers bool
+	// prune removes unmodified files that are no longer part of the environ
+	prune bool
+}
+
+func pull(environ Environ, options pullOptions) error {
 	refContent, err := os.ReadFile(environ.Ref)
 	if err != nil {
 		return fmt.Errorf("failed to read ref file %s: %w", environ.Ref, err)
@@ -112,7 +214,7 @@ func pull(environ Environ) error {
 
 	ref := strings.TrimSpace(string(refContent))
 
-	zipData, err := environ.Remote.Get(ref)
+	zipData, err := fetchArchive(environ, ref)
 	if err != nil {
 		return fmt.Errorf("failed to download ZIP %s: %w", ref, err)
 	}
@@ -121,6 +223,9 @@ func pull(environ Environ) error {
 	if err != nil {
 		return fmt.Errorf("failed to read ZIP: %w", err)
 	}
+	if err := validateZip(zipReader); err != nil {
+		return err
+	}
 
 	expectedFiles := make(map[string]bool)
 	for _, file := range environ.Files {
@@ -152,22 +257,35 @@ func pull(environ Environ) error {
 		return fmt.Errorf("extraneous files in ZIP: %v", extraneousFiles)
 	}
 
-	changedFiles := 0
-	for _, file := range zipReader.File {
-		dir := filepath.Dir(file.Name)
-		if dir != "." {
-			if err := os.MkdirAll(dir, 0755); err != nil {
-				return fmt.Errorf("failed to create directory %s: %w", dir, err)
-			}
-		}
+	root, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	if removed, err := removeStaleTemps(environ.Files); err != nil {
+		return fmt.Errorf("failed to remove temporary files of an interrupted pull: %w", err)
+	} else if removed > 0 {
+		log.Printf("Removed %d temporary files left by an interrupted pull", removed)
+	}
 
-		rc, err := file.Open()
-		if err != nil {
-			return fmt.Errorf("failed to open file %s in ZIP: %w", file.Name, err)
+	state, err := loadState(environ.Name)
+	if err != nil {
+		return err
+	}
+	synced := syncState{ArchiveID: ref, Files: map[string]string{}}
+	var conflicts []string
+	// Conflicting keys of dotenv files can be written with -markers
+	mergeable := false
+
+	// Stage every changed file first, so that a failure leaves the working tree untouched
+	var transaction fileTransaction
+	defer transaction.Abort()
+	unchanged := make(map[string]os.FileMode)
+	for _, file := range zipReader.File {
+		if err := checkWritablePath(root, file.Name); err != nil {
+			return err
 		}
 
-		fileContent, err := io.ReadAll(rc)
-		rc.Close()
+		fileContent, err := readZipFileContent(file)
 		if err != nil {
 			return fmt.Errorf("failed to read file %s from ZIP: %w", file.Name, err)
 		}
@@ -176,25 +294,134 @@ func pull(environ Environ) error {
 		if err != nil {
 			return fmt.Errorf("failed to check if file %s has changed: %w", file.Name, err)
 		}
+		synced.Files[file.Name] = generateArchiveID(fileContent)
 
+		mode := entryMode(file, environ.Mode)
 		if hasChanged {
-			localFile, err := os.Create(file.Name)
+			modified, err := state.locallyModified(file.Name)
 			if err != nil {
-				return fmt.Errorf("failed to create local file %s: %w", file.Name, err)
+				return fmt.Errorf("failed to check if file %s was modified: %w", file.Name, err)
+			}
+			if modified && !options.force {
+				if fileFormat(file.Name, environ.Formats) != formatDotenv {
+					conflicts = append(conflicts, file.Name)
+					continue
+				}
+				merged, keyConflicts, err := mergeWithBase(environ, state.ArchiveID, ref, file.Name, fileContent, options.markers)
+				if err != nil {
+					return err
+				}
+				if len(keyConflicts) > 0 && !options.markers {
+					conflicts = append(conflicts, fmt.Sprintf("%s (keys %s)", file.Name, strings.Join(keyConflicts, ", ")))
+					mergeable = true
+					continue
+				}
+				mergedChanged, err := fileHasChanged(file.Name, merged)
+				if err != nil {
+					return fmt.Errorf("failed to check if file %s has changed: %w", file.Name, err)
+				}
+				if !mergedChanged {
+					// Only local changes
+					continue
+				}
+				if len(keyConflicts) > 0 {
+					log.Printf("Wrote conflict markers to %s for keys %s", file.Name, strings.Join(keyConflicts, ", "))
+				} else {
+					log.Printf("Merged local changes to %s", file.Name)
+				}
+				fileContent = merged
 			}
+			if err := transaction.Stage(file.Name, fileContent, mode); err != nil {
+				return err
+			}
+		} else {
+			unchanged[file.Name] = mode
+		}
+	}
 
-			_, err = localFile.Write(fileContent)
-			localFile.Close()
-			if err != nil {
-				return fmt.Errorf("failed to write file %s: %w", file.Name, err)
+	// Files synced before that are no longer part of the environ, nor moved to
+	// another one
+	declaredFiles := make(map[string]bool)
+	for _, other := range environs {
+		for _, name := range other.Files {
+			declaredFiles[name] = true
+		}
+	}
+	changedFiles := len(transaction.staged)
+	var orphans []string
+	for name := range state.Files {
+		if expectedFiles[name] || declaredFiles[name] {
+			continue
+		}
+		if _, err := os.Lstat(name); os.IsNotExist(err) {
+			continue
+		}
+		if err := checkWritablePath(root, name); err != nil {
+			return err
+		}
+		modified, err := state.locallyModified(name)
+		if err != nil {
+			return fmt.Errorf("failed to check if file %s was modified: %w", name, err)
+		}
+		if options.prune && !modified {
+			if err := transaction.StageRemoval(name); err != nil {
+				return err
 			}
-			changedFiles++
+			continue
+		}
+		// Keep tracking it until it is pruned
+		synced.Files[name] = state.Files[name]
+		orphans = append(orphans, name)
+	}
+	sort.Strings(orphans)
+
+	if len(conflicts) > 0 {
+		since := "since the last pull or push of " + state.ArchiveID
+		if state.ArchiveID == "" {
+			since = "locally, with no record of a previous pull or push,"
+		}
+		flags := "-force"
+		if mergeable {
+			flags = "-markers or -force"
+		}
+		return fmt.Errorf("files modified %s would be overwritten: %s; push them first, or pull with %s", since, strings.Join(conflicts, "; "), flags)
+	}
+
+	prunedFiles := len(transaction.staged) - changedFiles
+	if err := commitWithBackup(environ.Name, &transaction, state); err != nil {
+		return err
+	}
+	if err := saveState(environ.Name, synced); err != nil {
+		return err
+	}
+
+	tightenedFiles := 0
+	for name, mode := range unchanged {
+		tightened, err := tightenMode(name, mode)
+		if err != nil {
+			return fmt.Errorf("failed to tighten mode of %s: %w", name, err)
+		}
+		if tightened {
+			tightenedFiles++
 		}
 	}
 
 	if changedFiles > 0 {
 		log.Printf("Changed %d/%d files from %s", changedFiles, len(environ.Files), ref)
 	}
+	if prunedFiles > 0 {
+		log.Printf("Removed %d files no longer in %s", prunedFiles, environ.Name)
+	}
+	if len(orphans) > 0 {
+		if options.prune {
+			log.Printf("Warning: kept files no longer in %s because they were modified since the last pull or push: %s", environ.Name, strings.Join(orphans, ", "))
+		} else {
+			log.Printf("Warning: files no longer in %s are left in place: %s; pull with -prune to remove them", environ.Name, strings.Join(orphans, ", "))
+		}
+	}
+	if tightenedFiles > 0 {
+		log.Printf("Tightened permissions of %d/%d files to at most %#o", tightenedFiles, len(environ.Files), environ.Mode)
+	}
 	return nil
 }
 
@@ -213,26 +440,64 @@ func push(environ Environ) error {
 
 	archiveID := generateArchiveID(zipData)
 
-	// Check if already up to date
+	fileHashes, err := zipFileHashes(zipData)
+	if err != nil {
+		return err
+	}
+	synced := syncState{ArchiveID: archiveID, Files: fileHashes}
+	// Keep tracking files dropped from the environ, so that pull can prune them
+	state, err := loadState(environ.Name)
+	if err != nil {
+		return err
+	}
+	for name, hash := range state.Files {
+		if _, ok := synced.Files[name]; !ok {
+			synced.Files[name] = hash
+		}
+	}
+
+	// Check if already up to date, still signing it in case the signing key
+	// was added since, or belongs to a new co-signer
 	if currentRef, err := os.ReadFile(environ.Ref); err == nil && string(currentRef) == archiveID {
 		log.Printf("Already up to date: %s", archiveID)
-		return nil
+		if environ.SigningKey != "" {
+			if err := signArchive(environ, archiveID, zipData); err != nil {
+				return err
+			}
+		}
+		return saveState(environ.Name, synced)
 	}
 
 	// Upload to remote
 	if err := environ.Remote.Write(archiveID, zipData); err != nil {
 		return fmt.Errorf("failed to upload archive: %w", err)
 	}
+	if environ.SigningKey != "" {
+		if err := signArchive(environ, archiveID, zipData); err != nil {
+			return err
+		}
+	}
 
 	// Update ref file
 	if err := os.WriteFile(environ.Ref, []byte(archiveID), 0644); err != nil {
 		return fmt.Errorf("failed to update ref file %q: %w", environ.Ref, err)
 	}
+	if err := saveState(environ.Name, synced); err != nil {
+		return err
+	}
 
 	log.Printf("Pushed %d files to %s as %s", len(environ.Files), environ.String(), archiveID)
 	return nil
 }
 
+// verifyArchive checks that data hashes to its archive ID
+func verifyArchive(archiveID string, data []byte) error {
+	if actual := generateArchiveID(data); actual != archiveID {
+		return archiveHashMismatch(archiveID, actual)
+	}
+	return nil
+}
+
 // isArchiveID checks if a string is a valid archive ID (base64 URL-encoded SHA256)
 func isArchiveID(s string) bool {
 	decoded, err := base64.RawURLEncoding.DecodeString(s)
@@ -257,7 +522,14 @@ func readRefFile(path string) (string, error) {
 func getZipFromSource(environ Environ, source string) ([]byte, string, error) {
 	var archiveID string
 
-	if isArchiveID(source) {
+	if revision, ok := strings.CutPrefix(source, "git:"); ok {
+		// Ref file at a git revision
+		ref, err := refAtRevision(revision, environ.Ref)
+		if err != nil {
+			return nil, "", err
+		}
+		archiveID = ref
+	} else if isArchiveID(source) {
 		archiveID = source
 	} else {
 		// Treat as ref file
@@ -268,13 +540,57 @@ func getZipFromSource(environ Environ, source string) ([]byte, string, error) {
 		archiveID = ref
 	}
 
-	zipData, err := environ.Remote.Get(archiveID)
+	zipData, err := fetchArchive(environ, archiveID)
 	if err != nil {
 		return nil, "", fmt.Errorf("failed to download archive %s: %w", archiveID, err)
 	}
 	return zipData, archiveID, nil
 }
 
+// refreshCached replaces key in every cache in remote with the copy from its origin
+func refreshCached(remote Remote, key string) (bool, error) {
+	refreshed := false
+	var err error
+	walkRemotes(remote, func(r Remote) {
+		if c, ok := r.(Cache); ok && err == nil {
+			refreshed = true
+			_, err = c.Refresh(key)
+		}
+	})
+	return refreshed, err
+}
+
+// fetchArchive downloads an archive, checks that it hashes to its archive ID
+// and that it is signed by a trusted signer. Caches verify plaintext archives
+// themselves; an archive that only fails once decrypted, with a cache below the
+// encryption, is downloaded again from the origin.
+func fetchArchive(environ Environ, archiveID string) ([]byte, error) {
+	zipData, err := environ.Remote.Get(archiveID)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyArchive(archiveID, zipData); err != nil {
+		refreshed, refreshErr := refreshCached(environ.Remote, archiveID)
+		if refreshErr != nil {
+			return nil, fmt.Errorf("failed to replace corrupted archive %s in cache: %w", archiveID, refreshErr)
+		}
+		if !refreshed {
+			return nil, err
+		}
+		log.Printf("Replaced corrupted archive %s in cache", archiveID)
+		if zipData, err = environ.Remote.Get(archiveID); err != nil {
+			return nil, err
+		}
+		if err := verifyArchive(archiveID, zipData); err != nil {
+			return nil, err
+		}
+	}
+	if err := verifySignature(environ, archiveID, zipData); err != nil {
+		return nil, err
+	}
+	return zipData, nil
+}
+
 // getLocalZipData creates a ZIP archive from files in the current directory
 func getLocalZipData(environ Environ) ([]byte, error) {
 	var buf bytes.Buffer
@@ -289,7 +605,7 @@ func getLocalZipData(environ Environ) ([]byte, error) {
 			return nil, fmt.Errorf("failed to read %q: %w", file, err)
 		}
 
-		fileWriter, err := zipWriter.Create(file)
+		fileWriter, err := createZipEntry(zipWriter, file, environ.Mode)
 		if err != nil {
 			return nil, fmt.Errorf("failed to create ZIP entry for %q: %w", file, err)
 		}
@@ -321,7 +637,7 @@ func getLocalZipDataForDiff(environ Environ) ([]byte, []string, error) {
 			return nil, nil, fmt.Errorf("failed to read %q: %w", file, err)
 		}
 
-		fileWriter, err := zipWriter.Create(file)
+		fileWriter, err := createZipEntry(zipWriter, file, environ.Mode)
 		if err != nil {
 			return nil, nil, fmt.Errorf("failed to create ZIP entry for %q: %w", file, err)
 		}
@@ -338,15 +654,6 @@ func getLocalZipDataForDiff(environ Environ) ([]byte, []string, error) {
 	return buf.Bytes(), missing, nil
 }
 
-func readZipFileContent(file *zip.File) ([]byte, error) {
-	reader, err := file.Open()
-	if err != nil {
-		return nil, err
-	}
-	defer reader.Close()
-	return io.ReadAll(reader)
-}
-
 func splitLines(content []byte) []string {
 	if len(content) == 0 {
 		return nil
@@ -358,132 +665,13 @@ func splitLines(content []byte) []string {
 	return lines
 }
 
-func diffRange(length int) string {
-	if length == 0 {
-		return "0,0"
-	}
-	return fmt.Sprintf("1,%d", length)
-}
-
-func printSingleSidedDiff(fileName, fromLabel, toLabel string, fromContent, toContent []byte) {
-	fromLines := splitLines(fromContent)
-	toLines := splitLines(toContent)
-
-	fmt.Printf("--- %s (%s)\n", fileName, fromLabel)
-	fmt.Printf("+++ %s (%s)\n", fileName, toLabel)
-	fmt.Printf("@@ -%s +%s @@\n", diffRange(len(fromLines)), diffRange(len(toLines)))
-
-	for _, line := range fromLines {
-		fmt.Printf("-%s\n", line)
-	}
-	for _, line := range toLines {
-		fmt.Printf("+%s\n", line)
-	}
-}
-
-func diffZips(fromZipData, toZipData []byte, fromLabel, toLabel string) (bool, error) {
-	// Create ZIP readers
-	fromZipReader, err := zip.NewReader(bytes.NewReader(fromZipData), int64(len(fromZipData)))
-	if err != nil {
-		return false, fmt.Errorf("failed to read 'from' ZIP: %w", err)
-	}
-
-	toZipReader, err := zip.NewReader(bytes.NewReader(toZipData), int64(len(toZipData)))
-	if err != nil {
-		return false, fmt.Errorf("failed to read 'to' ZIP: %w", err)
-	}
-
-	// Build file maps
-	fromFiles := make(map[string]*zip.File)
-	for _, file := range fromZipReader.File {
-		fromFiles[file.Name] = file
-	}
-
-	toFiles := make(map[string]*zip.File)
-	for _, file := range toZipReader.File {
-		toFiles[file.Name] = file
-	}
-
-	// Check all files
-	allFiles := make(map[string]bool)
-	for name := range fromFiles {
-		allFiles[name] = true
-	}
-	for name := range toFiles {
-		allFiles[name] = true
-	}
-
-	// Sort files for consistent output
-	var fileList []string
-	for file := range allFiles {
-		fileList = append(fileList, file)
-	}
-	sort.Strings(fileList)
-
-	// Diff each file
-	hasDiff := false
-	for _, fileName := range fileList {
-		fromFile, fromExists := fromFiles[fileName]
-		toFile, toExists := toFiles[fileName]
-
-		if !fromExists && toExists {
-			fmt.Printf("!!! file %s only in %s\n", fileName, toLabel)
-			content, err := readZipFileContent(toFile)
-			if err != nil {
-				return false, fmt.Errorf("failed to read %s from %s ZIP: %w", fileName, toLabel, err)
-			}
-			printSingleSidedDiff(fileName, fromLabel, toLabel, nil, content)
-			hasDiff = true
-			continue
-		}
-		if fromExists && !toExists {
-			fmt.Printf("!!! file %s only in %s\n", fileName, fromLabel)
-			content, err := readZipFileContent(fromFile)
-			if err != nil {
-				return false, fmt.Errorf("failed to read %s from %s ZIP: %w", fileName, fromLabel, err)
-			}
-			printSingleSidedDiff(fileName, fromLabel, toLabel, content, nil)
-			hasDiff = true
-			continue
-		}
-
-		// Both exist, compare contents
-		fromContent, err := readZipFileContent(fromFile)
-		if err != nil {
-			return false, fmt.Errorf("failed to read file %s in %s ZIP: %w", fileName, fromLabel, err)
-		}
-
-		toContent, err := readZipFileContent(toFile)
-		if err != nil {
-			return false, fmt.Errorf("failed to read file %s in %s ZIP: %w", fileName, toLabel, err)
-		}
-
-		if !bytes.Equal(fromContent, toContent) {
-			diff := patience.Diff(strings.Split(string(fromContent), "\n"), strings.Split(string(toContent), "\n"))
-			unidiff := patience.UnifiedDiffTextWithOptions(
-				diff,
-				patience.UnifiedDiffOptions{
-					Precontext:  1,
-					Postcontext: 1,
-					SrcHeader:   fmt.Sprintf("%s (%s)", fileName, fromLabel),
-					DstHeader:   fmt.Sprintf("%s (%s)", fileName, toLabel),
-				},
-			)
-			fmt.Print(unidiff)
-			hasDiff = true
-		}
-	}
-
-	return hasDiff, nil
-}
-
-func pullAll(environNames []string) error {
+func pullAll(environNames []string, options pullOptions) error {
 	for _, environName := range environNames {
 		environ, ok := environs[environName]
 		if !ok {
 			return envNotFound(environName)
 		}
-		if err := pull(environ); err != nil {
+		if err := pull(environ, options); err != nil {
 			return fmt.Errorf("failed to pull %s: %w", environName, err)
 		}
 	}
@@ -503,86 +691,15 @@ func pushAll(environNames []string) error {
 	return nil
 }
 
-func diffAll(environNames []string, from, to string) (bool, error) {
-	var anyDiff bool
-	for _, environName := range environNames {
-		environ, ok := environs[environName]
-		if !ok {
-			return anyDiff, envNotFound(environName)
-		}
-
-		changed, err := diffEnviron(environ, from, to)
-		if err != nil {
-			return anyDiff, fmt.Errorf("failed to diff %s: %w", environName, err)
-		}
-		if changed {
-			anyDiff = true
-		}
-	}
-	return anyDiff, nil
-}
-
-// diffEnviron performs diff for a single environment with the given from/to parameters and reports if differences were found.
-func diffEnviron(environ Environ, from, to string) (bool, error) {
-	// Resolve from parameter (default to ref file content)
-	fromSource := from
-	if fromSource == "" {
-		ref, err := readRefFile(environ.Ref)
-		if err != nil {
-			return false, err
-		}
-		fromSource = ref
-	}
-
-	// Get ZIP data for comparison
-	fromZipData, fromID, err := getZipFromSource(environ, fromSource)
-	if err != nil {
-		return false, fmt.Errorf("failed to get 'from' source: %w", err)
-	}
-
-	var toZipData []byte
-	var toLabel string
-	hasDiff := false
-
-	if to == "" {
-		// Compare with current directory when no -to flag specified
-		var missing []string
-		toZipData, missing, err = getLocalZipDataForDiff(environ)
-		if err != nil {
-			return false, err
-		}
-		for _, file := range missing {
-			fmt.Printf("!!! tracked file %s missing locally; treating as absent in diff target\n", file)
-		}
-		if len(missing) > 0 {
-			hasDiff = true
-		}
-		// Generate archive ID for local data to use as label
-		toLabel = generateArchiveID(toZipData) + " (local)"
-	} else {
-		// Compare with another ref
-		var toID string
-		toZipData, toID, err = getZipFromSource(environ, to)
-		if err != nil {
-			return false, fmt.Errorf("failed to get 'to' source: %w", err)
-		}
-		toLabel = toID
-	}
-
-	// Use first 12 chars of archive IDs for brevity in diff output
-	fromLabel := fromID
-	if len(fromLabel) > 12 {
-		fromLabel = fromLabel[:12]
-	}
-	if len(toLabel) > 12 && !strings.HasSuffix(toLabel, " (local)") {
-		toLabel = toLabel[:12]
+// environNamesOrAll defaults to every declared environ when none are named
+func environNamesOrAll(names []string) []string {
+	if len(names) > 0 {
+		return names
 	}
-
-	diffFound, err := diffZips(fromZipData, toZipData, fromLabel, toLabel)
-	if err != nil {
-		return false, err
+	for name := range environs {
+		names = append(names, name)
 	}
-	return hasDiff || diffFound, nil
+	return names
 }
 
 func printAvailableEnvirons() {
@@ -615,11 +732,21 @@ func main() {
 	}
 
 	globals := starlark.StringDict{
-		"gcs":     starlark.NewBuiltin("gcs", gcsfunc),
-		"s3":      starlark.NewBuiltin("s3", s3func),
-		"local":   starlark.NewBuiltin("local", local),
-		"cache":   starlark.NewBuiltin("cache", cache),
-		"environ": starlark.NewBuiltin("environ", environ),
+		"gcs":       starlark.NewBuiltin("gcs", gcsfunc),
+		"s3":        starlark.NewBuiltin("s3", s3func),
+		"azblob":    starlark.NewBuiltin("azblob", azblobfunc),
+		"http":      starlark.NewBuiltin("http", httpfunc),
+		"sftp":      starlark.NewBuiltin("sftp", sftpfunc),
+		"git":       starlark.NewBuiltin("git", gitfunc),
+		"vault":     starlark.NewBuiltin("vault", vaultfunc),
+		"local":     starlark.NewBuiltin("local", local),
+		"cache":     starlark.NewBuiltin("cache", cache),
+		"age":       starlark.NewBuiltin("age", agefunc),
+		"encrypted": starlark.NewBuiltin("encrypted", encrypted),
+		"file_key":  starlark.NewBuiltin("file_key", fileKey),
+		"file":      starlark.NewBuiltin("file", file),
+		"pgp":       starlark.NewBuiltin("pgp", pgpfunc),
+		"environ":   starlark.NewBuiltin("environ", environ),
 	}
 
 	_, err = starlark.ExecFileOptions(&opts, &thread, "environ.star", nil, globals)
@@ -629,8 +756,16 @@ func main() {
 
 	if len(os.Args) < 2 {
 		fmt.Printf("Usage: %s pull|push|diff [environ ...]\n", os.Args[0])
-		fmt.Printf("       %s diff [-from ref] [-to ref] [environ ...]\n", os.Args[0])
+		fmt.Printf("       %s pull [-force] [-markers] [-prune] [environ ...]\n", os.Args[0])
+		fmt.Printf("       %s diff [-from ref] [-to ref] [-keys] [-format text|json] [-show-values] [environ ...]\n", os.Args[0])
 		fmt.Printf("       (-from defaults to the contents of the ref file; -to defaults to the checked out file)\n")
+		fmt.Printf("       (refs are archive IDs, ref files, or git:<revision> for the ref file at a git revision)\n")
+		fmt.Printf("       %s rekey [-ids id,... environ | environ ...]\n", os.Args[0])
+		fmt.Printf("       %s migrate-cache [environ ...]\n", os.Args[0])
+		fmt.Printf("       %s status [-json] [environ ...]\n", os.Args[0])
+		fmt.Printf("       (exits with 2 if there are local changes, 3 if the ref is not pushed)\n")
+		fmt.Printf("       %s log [-keys] [environ ...]\n", os.Args[0])
+		fmt.Printf("       %s restore-backup [id]\n", os.Args[0])
 		printAvailableEnvirons()
 		os.Exit(0)
 	}
@@ -641,46 +776,119 @@ func main() {
 	var environNames []string
 	var from, to string
 	var diffChanged bool
+	var diffKeys, diffShowValues bool
+	var diffFormat string
+	var archiveIDs []string
+	var pullOpts pullOptions
+	var backupID string
+	var statusJSON bool
+	var statusCode int
+	var logKeys bool
 
 	if cmd == "diff" {
 		// diff command supports optional -from and -to flags
 		diffFlags := flag.NewFlagSet("diff", flag.ContinueOnError)
-		diffFlags.StringVar(&from, "from", "", "source ref (archive ID or ref file)")
-		diffFlags.StringVar(&to, "to", "", "target ref (archive ID or ref file)")
+		diffFlags.StringVar(&from, "from", "", "source ref (archive ID, ref file, or git:<revision>)")
+		diffFlags.StringVar(&to, "to", "", "target ref (archive ID, ref file, or git:<revision>)")
+		diffFlags.BoolVar(&diffKeys, "keys", false, "diff dotenv, JSON, YAML and tfvars files key by key, with values replaced by salted hashes")
+		diffFlags.BoolVar(&diffShowValues, "show-values", false, "show values in -keys and -format=json diffs")
+		diffFlags.StringVar(&diffFormat, "format", "text", "output format, text or json")
 
 		// Parse flags
 		err := diffFlags.Parse(os.Args[2:])
+		if err == nil && diffFormat != "text" && diffFormat != "json" {
+			err = fmt.Errorf("unknown format %q", diffFormat)
+			fmt.Println(err)
+		}
 		if err != nil {
-			fmt.Printf("Usage: %s diff [-from ref] [-to ref] [environ ...]\n", os.Args[0])
+			fmt.Printf("Usage: %s diff [-from ref] [-to ref] [-keys] [-format text|json] [-show-values] [environ ...]\n", os.Args[0])
 			os.Exit(1)
 		}
 
 		// Remaining args after flags are environ names
-		environNames = diffFlags.Args()
-		if len(environNames) == 0 {
-			// Default to all environments
-			for name := range environs {
-				environNames = append(environNames, name)
-			}
+		environNames = environNamesOrAll(diffFlags.Args())
+	} else if cmd == "pull" {
+		pullFlags := flag.NewFlagSet("pull", flag.ContinueOnError)
+		pullFlags.BoolVar(&pullOpts.force, "force", false, "overwrite files modified since the last pull or push")
+		pullFlags.BoolVar(&pullOpts.markers, "markers", false, "write conflict markers for dotenv keys changed both locally and in the archive")
+		pullFlags.BoolVar(&pullOpts.prune, "prune", false, "remove files that are no longer part of the environ")
+		if err := pullFlags.Parse(os.Args[2:]); err != nil {
+			fmt.Printf("Usage: %s pull [-force] [-markers] [-prune] [environ ...]\n", os.Args[0])
+			os.Exit(1)
 		}
-	} else {
-		// For pull/push commands, all args after command are environ names
-		if len(os.Args) > 2 {
-			environNames = os.Args[2:]
-		} else {
-			for name := range environs {
-				environNames = append(environNames, name)
+		environNames = environNamesOrAll(pullFlags.Args())
+	} else if cmd == "rekey" {
+		rekeyFlags := flag.NewFlagSet("rekey", flag.ContinueOnError)
+		var ids string
+		rekeyFlags.StringVar(&ids, "ids", "", "comma-separated archive IDs of a single environ (defaults to every archive in the history of the ref file)")
+		if err := rekeyFlags.Parse(os.Args[2:]); err != nil {
+			fmt.Printf("Usage: %s rekey [-ids id,... environ | environ ...]\n", os.Args[0])
+			os.Exit(1)
+		}
+		if ids != "" {
+			// Archive IDs belong to a single environ
+			if rekeyFlags.NArg() != 1 {
+				fmt.Printf("-ids needs exactly one environ\n")
+				fmt.Printf("Usage: %s rekey [-ids id,... environ | environ ...]\n", os.Args[0])
+				os.Exit(1)
 			}
+			archiveIDs = strings.Split(ids, ",")
+		}
+		environNames = environNamesOrAll(rekeyFlags.Args())
+	} else if cmd == "status" {
+		statusFlags := flag.NewFlagSet("status", flag.ContinueOnError)
+		statusFlags.BoolVar(&statusJSON, "json", false, "print the status as JSON")
+		if err := statusFlags.Parse(os.Args[2:]); err != nil {
+			fmt.Printf("Usage: %s status [-json] [environ ...]\n", os.Args[0])
+			os.Exit(1)
+		}
+		environNames = environNamesOrAll(statusFlags.Args())
+	} else if cmd == "log" {
+		logFlags := flag.NewFlagSet("log", flag.ContinueOnError)
+		logFlags.BoolVar(&logKeys, "keys", false, "list the dotenv keys each commit changed, without their values")
+		if err := logFlags.Parse(os.Args[2:]); err != nil {
+			fmt.Printf("Usage: %s log [-keys] [environ ...]\n", os.Args[0])
+			os.Exit(1)
 		}
+		environNames = environNamesOrAll(logFlags.Args())
+	} else if cmd == "restore-backup" {
+		// restore-backup takes a backup ID rather than environ names
+		if len(os.Args) > 3 {
+			fmt.Printf("Usage: %s restore-backup [id]\n", os.Args[0])
+			os.Exit(1)
+		}
+		if len(os.Args) == 3 {
+			backupID = os.Args[2]
+		}
+	} else {
+		// For other commands, all args after command are environ names
+		environNames = environNamesOrAll(os.Args[2:])
 	}
 
 	switch cmd {
 	case "pull":
-		err = pullAll(environNames)
+		err = pullAll(environNames, pullOpts)
 	case "push":
 		err = pushAll(environNames)
 	case "diff":
-		diffChanged, err = diffAll(environNames, from, to)
+		var options diffOptions
+		if options, err = newDiffOptions(diffKeys, diffShowValues, diffFormat == "json"); err == nil {
+			diffChanged, err = diffAll(environNames, from, to, options)
+		}
+	case "rekey":
+		err = rekeyAll(environNames, archiveIDs)
+	case "migrate-cache":
+		err = migrateCacheAll(environNames)
+	case "status":
+		statusCode, err = statusAll(environNames, statusJSON)
+	case "log":
+		err = logAll(environNames, logKeys)
+	case "restore-backup":
+		if backupID == "" {
+			err = listBackups()
+		} else {
+			err = restoreBackup(backupID)
+		}
 	default:
 		log.Printf("%s is not a valid command", cmd)
 		os.Exit(1)
@@ -696,4 +904,5 @@ func main() {
 	if cmd == "diff" && diffChanged {
 		os.Exit(1)
 	}
+	os.Exit(statusCode)
 }
@@ -3,13 +3,47 @@ package main
 import (
 	"archive/zip"
 	"bytes"
+	"encoding/json"
+	"errors"
 	"io"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
 	"sort"
 	"strings"
 	"testing"
+
+	"go.starlark.net/starlark"
 )
 
+// memoryRemote is an in-memory Remote for tests
+type memoryRemote map[string][]byte
+
+func (m memoryRemote) Get(key string) ([]byte, error) {
+	value, ok := m[key]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return value, nil
+}
+
+func (m memoryRemote) Write(key string, value []byte) error {
+	m[key] = value
+	return nil
+}
+
+func (m memoryRemote) Overwrite(key string, value []byte) error {
+	m[key] = value
+	return nil
+}
+
+func (m memoryRemote) String() string        { return "memory" }
+func (m memoryRemote) Type() string          { return "memory" }
+func (m memoryRemote) Freeze()               {}
+func (m memoryRemote) Truth() starlark.Bool  { return starlark.Bool(true) }
+func (m memoryRemote) Hash() (uint32, error) { return 0, nil }
+
 func captureOutput(t *testing.T, fn func()) string {
 	t.Helper()
 	originalStdout := os.Stdout
@@ -39,6 +73,38 @@ func captureOutput(t *testing.T, fn func()) string {
 	return string(output)
 }
 
+// initGitRepo makes the current directory a git repository, with a test identity
+// and no user configuration
+func initGitRepo(t *testing.T) {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not available")
+	}
+	t.Setenv("GIT_CONFIG_GLOBAL", os.DevNull)
+	t.Setenv("GIT_CONFIG_NOSYSTEM", "1")
+	t.Setenv("GIT_AUTHOR_NAME", "test")
+	t.Setenv("GIT_AUTHOR_EMAIL", "test@example.com")
+	t.Setenv("GIT_COMMITTER_NAME", "test")
+	t.Setenv("GIT_COMMITTER_EMAIL", "test@example.com")
+	if _, err := runGit("init", "-q"); err != nil {
+		t.Fatalf("git init failed: %v", err)
+	}
+}
+
+// commitFile writes a file in the current directory and commits it
+func commitFile(t *testing.T, name, content string) {
+	t.Helper()
+	if err := os.WriteFile(name, []byte(content), 0644); err != nil {
+		t.Fatalf("failed to write %s: %v", name, err)
+	}
+	if _, err := runGit("add", name); err != nil {
+		t.Fatalf("git add failed: %v", err)
+	}
+	if _, err := runGit("commit", "-q", "-m", "update "+name); err != nil {
+		t.Fatalf("git commit failed: %v", err)
+	}
+}
+
 func zipData(t *testing.T, entries map[string]string) []byte {
 	t.Helper()
 	var buf bytes.Buffer
@@ -67,22 +133,28 @@ func zipData(t *testing.T, entries map[string]string) []byte {
 	return buf.Bytes()
 }
 
-func TestDiffZipsPrintsContentForAddedFile(t *testing.T) {
+// printZipDiff compares two archives and prints the result as diff does
+func printZipDiff(t *testing.T, fromZip, toZip []byte, options diffOptions) (string, bool) {
+	t.Helper()
+	files, err := compareZips(fromZip, toZip, "QlgiIViuR", "rXtcTkVBF", options)
+	if err != nil {
+		t.Fatalf("compareZips returned error: %v", err)
+	}
+	output := captureOutput(t, func() {
+		printEnvironDiff(environDiff{Files: files, fromLabel: "QlgiIViuR", toLabel: "rXtcTkVBF"})
+	})
+	return output, len(files) > 0
+}
+
+func TestDiffPrintsContentForAddedFile(t *testing.T) {
 	fromZip := zipData(t, map[string]string{})
 	toZip := zipData(t, map[string]string{
 		"jaiminho/browse_agent/.env.sandbox": "FOO=bar\nBAZ=qux\n",
 	})
 
-	var changed bool
-	var err error
-	output := captureOutput(t, func() {
-		changed, err = diffZips(fromZip, toZip, "QlgiIViuR", "rXtcTkVBF")
-	})
-	if err != nil {
-		t.Fatalf("diffZips returned error: %v", err)
-	}
+	output, changed := printZipDiff(t, fromZip, toZip, diffOptions{})
 	if !changed {
-		t.Fatalf("expected diffZips to report changes for added file")
+		t.Fatalf("expected changes for added file")
 	}
 
 	if !strings.Contains(output, "!!! file jaiminho/browse_agent/.env.sandbox only in rXtcTkVBF") {
@@ -96,22 +168,15 @@ func TestDiffZipsPrintsContentForAddedFile(t *testing.T) {
 	}
 }
 
-func TestDiffZipsPrintsContentForDeletedFile(t *testing.T) {
+func TestDiffPrintsContentForDeletedFile(t *testing.T) {
 	fromZip := zipData(t, map[string]string{
 		"jaiminho/browse_agent/.env.prod": "SECRET=value\n",
 	})
 	toZip := zipData(t, map[string]string{})
 
-	var changed bool
-	var err error
-	output := captureOutput(t, func() {
-		changed, err = diffZips(fromZip, toZip, "QlgiIViuR", "rXtcTkVBF")
-	})
-	if err != nil {
-		t.Fatalf("diffZips returned error: %v", err)
-	}
+	output, changed := printZipDiff(t, fromZip, toZip, diffOptions{})
 	if !changed {
-		t.Fatalf("expected diffZips to report changes for deleted file")
+		t.Fatalf("expected changes for deleted file")
 	}
 
 	if !strings.Contains(output, "!!! file jaiminho/browse_agent/.env.prod only in QlgiIViuR") {
@@ -124,3 +189,179 @@ func TestDiffZipsPrintsContentForDeletedFile(t *testing.T) {
 		t.Fatalf("expected diff header for deleted file, got:\n%s", output)
 	}
 }
+
+func TestFetchArchiveReplacesCorruptedCacheEntry(t *testing.T) {
+	archive := zipData(t, map[string]string{".env": "SECRET=value\n"})
+	archiveID := generateArchiveID(archive)
+
+	origin := memoryRemote{archiveID: archive}
+	corrupted := zipData(t, map[string]string{".env": "SECRET=corrupted\n"})
+	for _, by := range []Remote{Local{path: t.TempDir()}, memoryRemote{}} {
+		if err := overwrite(by, archiveID, corrupted); err != nil {
+			t.Fatalf("failed to seed cache: %v", err)
+		}
+		environ := Environ{Remote: Cache{By: by, Of: origin}}
+
+		content, err := fetchArchive(environ, archiveID)
+		if err != nil {
+			t.Fatalf("fetchArchive returned error: %v", err)
+		}
+		if !bytes.Equal(content, archive) {
+			t.Fatalf("expected archive from origin")
+		}
+		cached, err := by.Get(archiveID)
+		if err != nil || !bytes.Equal(cached, archive) {
+			t.Fatalf("expected cache entry in %s to be replaced, got %q (%v)", by, cached, err)
+		}
+	}
+}
+
+func TestCacheNeverStoresTamperedArchive(t *testing.T) {
+	archive := zipData(t, map[string]string{".env": "SECRET=value\n"})
+	archiveID := generateArchiveID(archive)
+	origin := memoryRemote{archiveID: zipData(t, map[string]string{".env": "SECRET=tampered\n"})}
+	by := memoryRemote{}
+	environ := Environ{Remote: Cache{By: by, Of: origin}}
+
+	_, err := fetchArchive(environ, archiveID)
+	var mismatch ArchiveHashMismatch
+	if !errors.As(err, &mismatch) {
+		t.Fatalf("expected ArchiveHashMismatch, got %v", err)
+	}
+	if _, ok := by[archiveID]; ok {
+		t.Fatalf("expected tampered archive to stay out of the cache")
+	}
+}
+
+func TestGetZipFromSourceReadsRefAtGitRevision(t *testing.T) {
+	t.Chdir(t.TempDir())
+	initGitRepo(t)
+	archive := zipData(t, map[string]string{".env": "SECRET=value\n"})
+	archiveID := generateArchiveID(archive)
+	commitFile(t, "environ.hash", archiveID)
+	if err := os.WriteFile("environ.hash", []byte("changed"), 0644); err != nil {
+		t.Fatalf("failed to write ref: %v", err)
+	}
+	environ := Environ{Remote: memoryRemote{archiveID: archive}, Ref: "environ.hash"}
+
+	content, id, err := getZipFromSource(environ, "git:HEAD")
+	if err != nil {
+		t.Fatalf("getZipFromSource returned error: %v", err)
+	}
+	if id != archiveID || !bytes.Equal(content, archive) {
+		t.Fatalf("expected archive %s from HEAD, got %s", archiveID, id)
+	}
+
+	// As an option, this would write to leaked:./environ.hash
+	if err := os.Mkdir("leaked:.", 0755); err != nil {
+		t.Fatalf("failed to create directory: %v", err)
+	}
+	if _, _, err := getZipFromSource(environ, "git:--output=leaked"); err == nil {
+		t.Fatalf("expected a revision that looks like an option to fail")
+	}
+	if _, err := os.Stat(filepath.Join("leaked:.", "environ.hash")); !os.IsNotExist(err) {
+		t.Fatalf("expected the revision not to be taken for an option, got %v", err)
+	}
+}
+
+func TestNewDiffOptionsRejectsShowValuesWithoutKeys(t *testing.T) {
+	if _, err := newDiffOptions(false, true, false); err == nil {
+		t.Fatalf("expected -show-values without -keys to be rejected")
+	}
+}
+
+func TestDiffKeysHidesValues(t *testing.T) {
+	fromZip := zipData(t, map[string]string{".env": "KEEP=same\nOLD=gone\nTOKEN=old-secret\n"})
+	toZip := zipData(t, map[string]string{".env": "KEEP=same\nNEW=added\nTOKEN=new-secret\n"})
+	options, err := newDiffOptions(true, false, false)
+	if err != nil {
+		t.Fatalf("newDiffOptions returned error: %v", err)
+	}
+
+	output, changed := printZipDiff(t, fromZip, toZip, options)
+	if !changed {
+		t.Fatalf("expected changes")
+	}
+	for _, secret := range []string{"gone", "added", "old-secret", "new-secret"} {
+		if strings.Contains(output, secret) {
+			t.Fatalf("expected value %q to be hidden, got:\n%s", secret, output)
+		}
+	}
+	for _, line := range []string{"+ NEW=#", "- OLD=#", "~ TOKEN=#"} {
+		if !strings.Contains(output, line) {
+			t.Fatalf("expected %q in output, got:\n%s", line, output)
+		}
+	}
+	if strings.Contains(output, "KEEP") {
+		t.Fatalf("expected unchanged key to be left out, got:\n%s", output)
+	}
+}
+
+func TestDiffEnvironReportsFilesAsJSON(t *testing.T) {
+	t.Chdir(t.TempDir())
+	archive := zipData(t, map[string]string{".env": "A=1\nB=2\n", "gone.txt": "old\n"})
+	archiveID := generateArchiveID(archive)
+	if err := os.WriteFile("environ.hash", []byte(archiveID), 0644); err != nil {
+		t.Fatalf("failed to write ref: %v", err)
+	}
+	if err := os.WriteFile(".env", []byte("A=1\nB=3\n"), 0600); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	environ := Environ{
+		Remote: memoryRemote{archiveID: archive},
+		Name:   "test",
+		Files:  []string{".env", "gone.txt"},
+		Ref:    "environ.hash",
+		Mode:   defaultMode,
+	}
+
+	decode := func(showValues bool) (string, []fileDiff) {
+		t.Helper()
+		options, err := newDiffOptions(false, showValues, true)
+		if err != nil {
+			t.Fatalf("newDiffOptions returned error: %v", err)
+		}
+		diff, err := diffEnviron(environ, "", "", options)
+		if err != nil {
+			t.Fatalf("diffEnviron returned error: %v", err)
+		}
+		out, err := json.Marshal(diff)
+		if err != nil {
+			t.Fatalf("failed to marshal diff: %v", err)
+		}
+		var decoded struct {
+			From  string     `json:"from"`
+			Local bool       `json:"local"`
+			Files []fileDiff `json:"files"`
+		}
+		if err := json.Unmarshal(out, &decoded); err != nil {
+			t.Fatalf("failed to unmarshal diff: %v", err)
+		}
+		if decoded.From != archiveID || !decoded.Local || len(decoded.Files) != 2 {
+			t.Fatalf("unexpected diff %s", out)
+		}
+		return string(out), decoded.Files
+	}
+
+	// Values of keyed files are left out by default, text files are diffed line by line
+	out, files := decode(false)
+	env, gone := files[0], files[1]
+	if env.Name != ".env" || env.Status != "modified" || len(env.Hunks) != 0 || len(env.Keys) != 1 || env.Keys[0].Path != "B" {
+		t.Fatalf("unexpected diff of .env %+v", env)
+	}
+	if gone.Name != "gone.txt" || gone.Status != "missing" || len(gone.Hunks) != 1 || !reflect.DeepEqual(gone.Hunks[0].Lines, []string{"-old"}) {
+		t.Fatalf("unexpected diff of gone.txt %+v", gone)
+	}
+	if strings.Contains(out, "B=2") || strings.Contains(out, "B=3") {
+		t.Fatalf("expected values of .env to be left out, got %s", out)
+	}
+
+	_, files = decode(true)
+	env, gone = files[0], files[1]
+	if len(env.Keys) != 1 || !strings.Contains(env.Keys[0].To, "3") {
+		t.Fatalf("unexpected diff of .env %+v", env)
+	}
+	if len(gone.Hunks) != 1 || !reflect.DeepEqual(gone.Hunks[0].Lines, []string{"-old"}) {
+		t.Fatalf("unexpected diff of gone.txt %+v", gone)
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	pgperrors "github.com/ProtonMail/go-crypto/openpgp/errors"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+	"go.starlark.net/starlark"
+)
+
+const defaultPGPSecretKey = "~/.config/environ/secret.asc"
+
+func pgpfunc(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var of Remote
+	var recipients *starlark.List
+	keyring := ""
+	secretKey := ""
+	allowPlaintext := false
+	if err := starlark.UnpackArgs(fn.Name(), args, kwargs, "of", &of, "recipients", &recipients, "keyring", &keyring, "secret_key?", &secretKey, "allow_plaintext?", &allowPlaintext); err != nil {
+		return nil, err
+	}
+	if secretKey == "" {
+		secretKey = defaultPGPSecretKey
+	}
+	if recipients.Len() == 0 {
+		return nil, fmt.Errorf("%s: at least one recipient is required", fn.Name())
+	}
+	fingerprints := make([]string, recipients.Len())
+	for i := 0; i < recipients.Len(); i++ {
+		s, ok := recipients.Index(i).(starlark.String)
+		if !ok {
+			return nil, fmt.Errorf("%s: recipient %s is not a string", fn.Name(), recipients.Index(i))
+		}
+		fingerprint := strings.ToUpper(strings.ReplaceAll(s.GoString(), " ", ""))
+		if _, err := hex.DecodeString(fingerprint); err != nil {
+			return nil, fmt.Errorf("%s: recipient %s is not a fingerprint", fn.Name(), s)
+		}
+		fingerprints[i] = fingerprint
+	}
+	return PGP{
+		Of:             of,
+		recipients:     fingerprints,
+		keyring:        expandHome(keyring),
+		secretKey:      expandHome(secretKey),
+		allowPlaintext: allowPlaintext,
+	}, nil
+}
+
+// PGP encrypts archives to OpenPGP public keys from a keyring before handing
+// them to Of, and decrypts them with a local secret key on the way back
+type PGP struct {
+	Of             Remote
+	recipients     []string
+	keyring        string
+	secretKey      string
+	allowPlaintext bool
+}
+
+// readKeyRing reads an armored or binary OpenPGP keyring
+func readKeyRing(path string) (openpgp.EntityList, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read keyring: %w", err)
+	}
+	var entities openpgp.EntityList
+	if bytes.HasPrefix(bytes.TrimSpace(content), []byte("-----BEGIN")) {
+		entities, err = openpgp.ReadArmoredKeyRing(bytes.NewReader(content))
+	} else {
+		entities, err = openpgp.ReadKeyRing(bytes.NewReader(content))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse keyring %s: %w", path, err)
+	}
+	return entities, nil
+}
+
+func (p PGP) recipientEntities() ([]*openpgp.Entity, error) {
+	keyring, err := readKeyRing(p.keyring)
+	if err != nil {
+		return nil, err
+	}
+	byFingerprint := make(map[string]*openpgp.Entity)
+	for _, entity := range keyring {
+		byFingerprint[strings.ToUpper(hex.EncodeToString(entity.PrimaryKey.Fingerprint))] = entity
+	}
+	entities := make([]*openpgp.Entity, len(p.recipients))
+	for i, fingerprint := range p.recipients {
+		entity, ok := byFingerprint[fingerprint]
+		if !ok {
+			return nil, fmt.Errorf("recipient %s not found in keyring %s", fingerprint, p.keyring)
+		}
+		entities[i] = entity
+	}
+	return entities, nil
+}
+
+func (p PGP) encrypt(value []byte) ([]byte, error) {
+	to, err := p.recipientEntities()
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	writer, err := openpgp.Encrypt(&buf, to, nil, &openpgp.FileHints{IsBinary: true}, nil)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := writer.Write(value); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// encryptedTo lists the IDs of the keys a message was encrypted to
+func encryptedTo(content []byte) []uint64 {
+	packets := packet.NewReader(bytes.NewReader(content))
+	var keyIDs []uint64
+	for {
+		p, err := packets.Next()
+		if err != nil {
+			return keyIDs
+		}
+		encryptedKey, ok := p.(*packet.EncryptedKey)
+		if !ok {
+			return keyIDs
+		}
+		keyIDs = append(keyIDs, encryptedKey.KeyId)
+	}
+}
+
+// describeKeys names keys by their ID and, when found in the keyring, their primary identity
+func (p PGP) describeKeys(keyIDs []uint64) string {
+	keyring, _ := readKeyRing(p.keyring)
+	descriptions := make([]string, len(keyIDs))
+	for i, keyID := range keyIDs {
+		descriptions[i] = fmt.Sprintf("%016X", keyID)
+		for _, key := range keyring.KeysById(keyID) {
+			if identity := key.Entity.PrimaryIdentity(); identity != nil {
+				descriptions[i] += fmt.Sprintf(" (%s)", identity.Name)
+				break
+			}
+		}
+	}
+	return strings.Join(descriptions, ", ")
+}
+
+// promptPassphrase unlocks passphrase-protected secret keys from ENVIRON_PGP_PASSPHRASE
+func promptPassphrase(keys []openpgp.Key, symmetric bool) ([]byte, error) {
+	passphrase, ok := os.LookupEnv("ENVIRON_PGP_PASSPHRASE")
+	if !ok {
+		return nil, errors.New("secret key is passphrase-protected; set ENVIRON_PGP_PASSPHRASE")
+	}
+	for _, key := range keys {
+		if err := key.PrivateKey.Decrypt([]byte(passphrase)); err != nil {
+			return nil, fmt.Errorf("failed to unlock secret key %s: %w", key.PrivateKey.KeyIdString(), err)
+		}
+	}
+	return nil, nil
+}
+
+func (p PGP) Get(key string) ([]byte, error) {
+	content, err := p.Of.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	if plaintext, ok, err := readPlaintext(key, content, p.Of, p.allowPlaintext); ok {
+		return plaintext, err
+	}
+	secretKeys, err := readKeyRing(p.secretKey)
+	if err != nil {
+		return nil, err
+	}
+	message, err := openpgp.ReadMessage(bytes.NewReader(content), secretKeys, promptPassphrase, nil)
+	if errors.Is(err, pgperrors.ErrKeyIncorrect) {
+		return nil, fmt.Errorf("cannot decrypt archive %s: it is encrypted to %s, none of which are in %s", key, p.describeKeys(encryptedTo(content)), p.secretKey)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt archive %s: %w", key, err)
+	}
+	return io.ReadAll(message.UnverifiedBody)
+}
+
+func (p PGP) Write(key string, value []byte) error {
+	encrypted, err := p.encrypt(value)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt archive %s: %w", key, err)
+	}
+	return p.Of.Write(key, encrypted)
+}
+
+func (p PGP) Overwrite(key string, value []byte) error {
+	encrypted, err := p.encrypt(value)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt archive %s: %w", key, err)
+	}
+	return overwrite(p.Of, key, encrypted)
+}
+
+func (p PGP) Unwrap() []Remote {
+	return []Remote{p.Of}
+}
+
+func (p PGP) String() string {
+	return fmt.Sprintf("pgp(%s)", p.Of)
+}
+
+func (p PGP) Type() string {
+	return "PGP"
+}
+
+func (p PGP) Freeze() {
+}
+
+func (p PGP) Truth() starlark.Bool {
+	return starlark.Bool(true)
+}
+
+func (p PGP) Hash() (uint32, error) {
+	return starlark.String(p.String()).Hash()
+}
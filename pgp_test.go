@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+)
+
+func writeTestEntity(t *testing.T, dir, name string) (*openpgp.Entity, string) {
+	t.Helper()
+	entity, err := openpgp.NewEntity(name, "", name+"@example.com", nil)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	var secret bytes.Buffer
+	if err := entity.SerializePrivate(&secret, nil); err != nil {
+		t.Fatalf("failed to serialize secret key: %v", err)
+	}
+	path := filepath.Join(dir, name+".gpg")
+	if err := os.WriteFile(path, secret.Bytes(), 0600); err != nil {
+		t.Fatalf("failed to write secret key: %v", err)
+	}
+	return entity, path
+}
+
+func TestPGPRoundTripAndMissingKey(t *testing.T) {
+	dir := t.TempDir()
+	alice, aliceSecret := writeTestEntity(t, dir, "alice")
+	_, bobSecret := writeTestEntity(t, dir, "bob")
+
+	var keyring bytes.Buffer
+	if err := alice.Serialize(&keyring); err != nil {
+		t.Fatalf("failed to serialize public key: %v", err)
+	}
+	keyringPath := filepath.Join(dir, "pubring.gpg")
+	if err := os.WriteFile(keyringPath, keyring.Bytes(), 0644); err != nil {
+		t.Fatalf("failed to write keyring: %v", err)
+	}
+
+	inner := memoryRemote{}
+	remote := PGP{
+		Of:         inner,
+		recipients: []string{strings.ToUpper(hex.EncodeToString(alice.PrimaryKey.Fingerprint))},
+		keyring:    keyringPath,
+		secretKey:  aliceSecret,
+	}
+
+	archive := zipData(t, map[string]string{".env": "SECRET=value\n"})
+	if err := remote.Write("key", archive); err != nil {
+		t.Fatalf("Write returned error: %v", err)
+	}
+	decrypted, err := remote.Get("key")
+	if err != nil {
+		t.Fatalf("Get returned error: %v", err)
+	}
+	if !bytes.Equal(decrypted, archive) {
+		t.Fatalf("decrypted archive does not match original")
+	}
+
+	var plaintext PlaintextArchive
+	inner["plain"] = archive
+	if _, err := remote.Get("plain"); !errors.As(err, &plaintext) {
+		t.Fatalf("expected PlaintextArchive, got %v", err)
+	}
+
+	remote.secretKey = bobSecret
+	_, err = remote.Get("key")
+	if err == nil || !strings.Contains(err.Error(), "alice") {
+		t.Fatalf("expected error naming alice's key, got %v", err)
+	}
+}
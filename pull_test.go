@@ -0,0 +1,212 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testEnviron declares an environ backed by memory, in a new git repository
+// that becomes the current directory
+func testEnviron(t *testing.T, files ...string) Environ {
+	t.Helper()
+	t.Chdir(t.TempDir())
+	initGitRepo(t)
+	return Environ{
+		Remote: memoryRemote{},
+		Name:   "test",
+		Files:  files,
+		Ref:    "environ.hash",
+		Mode:   defaultMode,
+	}
+}
+
+func writeFile(t *testing.T, name, content string, mode os.FileMode) {
+	t.Helper()
+	if err := os.WriteFile(name, []byte(content), mode); err != nil {
+		t.Fatalf("failed to write %s: %v", name, err)
+	}
+	if err := os.Chmod(name, mode); err != nil {
+		t.Fatalf("failed to chmod %s: %v", name, err)
+	}
+}
+
+func readFile(t *testing.T, name string) string {
+	t.Helper()
+	content, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatalf("failed to read %s: %v", name, err)
+	}
+	return string(content)
+}
+
+func TestPullRestoresConfiguredMode(t *testing.T) {
+	environ := testEnviron(t, ".env")
+	writeFile(t, ".env", "SECRET=value\n", 0644)
+	loose, err := getLocalZipData(environ)
+	if err != nil {
+		t.Fatalf("getLocalZipData returned error: %v", err)
+	}
+	writeFile(t, ".env", "SECRET=value\n", 0600)
+	strict, err := getLocalZipData(environ)
+	if err != nil {
+		t.Fatalf("getLocalZipData returned error: %v", err)
+	}
+	if generateArchiveID(loose) != generateArchiveID(strict) {
+		t.Fatalf("expected the archive ID not to depend on local permissions")
+	}
+
+	if err := push(environ); err != nil {
+		t.Fatalf("push returned error: %v", err)
+	}
+	if err := os.Remove(".env"); err != nil {
+		t.Fatalf("failed to remove .env: %v", err)
+	}
+	if err := pull(environ, pullOptions{}); err != nil {
+		t.Fatalf("pull returned error: %v", err)
+	}
+	info, err := os.Stat(".env")
+	if err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("expected .env to be extracted with mode 0600, got %v (%v)", info.Mode().Perm(), err)
+	}
+}
+
+// pushElsewhere writes an archive to the remote and points the reference at
+// it, like a push from another clone
+func pushElsewhere(t *testing.T, environ Environ, entries map[string]string) {
+	t.Helper()
+	archive := zipData(t, entries)
+	id := generateArchiveID(archive)
+	if err := environ.Remote.Write(id, archive); err != nil {
+		t.Fatalf("failed to write archive: %v", err)
+	}
+	writeFile(t, environ.Ref, id+"\n", 0644)
+}
+
+func TestPullRefusesToOverwriteLocalEdits(t *testing.T) {
+	environ := testEnviron(t, "secrets.txt")
+	writeFile(t, "secrets.txt", "first\n", 0600)
+	if err := push(environ); err != nil {
+		t.Fatalf("push returned error: %v", err)
+	}
+	pushElsewhere(t, environ, map[string]string{"secrets.txt": "second\n"})
+	writeFile(t, "secrets.txt", "local\n", 0600)
+
+	err := pull(environ, pullOptions{})
+	if err == nil || !strings.Contains(err.Error(), "secrets.txt") || strings.Contains(err.Error(), "-markers") {
+		t.Fatalf("expected pull to refuse to overwrite secrets.txt, without suggesting -markers, got %v", err)
+	}
+	if content := readFile(t, "secrets.txt"); content != "local\n" {
+		t.Fatalf("expected local edits to be kept, got %q", content)
+	}
+
+	if err := pull(environ, pullOptions{force: true}); err != nil {
+		t.Fatalf("pull -force returned error: %v", err)
+	}
+	if content := readFile(t, "secrets.txt"); content != "second\n" {
+		t.Fatalf("expected pull -force to overwrite local edits, got %q", content)
+	}
+}
+
+func TestPullWithoutStateRefusesToOverwriteDifferentFiles(t *testing.T) {
+	environ := testEnviron(t, "secrets.txt", ".env")
+	pushElsewhere(t, environ, map[string]string{"secrets.txt": "remote\n", ".env": "A=remote\nB=2\n"})
+	writeFile(t, "secrets.txt", "local\n", 0600)
+	writeFile(t, ".env", "A=local\n", 0600)
+
+	err := pull(environ, pullOptions{})
+	if err == nil || !strings.Contains(err.Error(), "secrets.txt") || !strings.Contains(err.Error(), ".env (keys A)") || !strings.Contains(err.Error(), "-markers") {
+		t.Fatalf("expected pull to refuse to overwrite files never synced, got %v", err)
+	}
+	if content := readFile(t, "secrets.txt"); content != "local\n" {
+		t.Fatalf("expected local content to be kept, got %q", content)
+	}
+
+	// Files identical to the archive are not conflicts
+	writeFile(t, "secrets.txt", "remote\n", 0600)
+	writeFile(t, ".env", "A=remote\n", 0600)
+	if err := pull(environ, pullOptions{}); err != nil {
+		t.Fatalf("pull returned error: %v", err)
+	}
+	if content := readFile(t, ".env"); content != "A=remote\nB=2\n" {
+		t.Fatalf("expected keys added in the archive to be merged, got %q", content)
+	}
+}
+
+func TestPullMarkersMergesFilesDeclaredDotenv(t *testing.T) {
+	environ := testEnviron(t, "app.conf")
+	environ.Formats = map[string]string{"app.conf": formatDotenv}
+	writeFile(t, "app.conf", "A=1\nB=1\n", 0600)
+	if err := push(environ); err != nil {
+		t.Fatalf("push returned error: %v", err)
+	}
+	pushElsewhere(t, environ, map[string]string{"app.conf": "A=remote\nB=remote\n"})
+	writeFile(t, "app.conf", "A=1\nB=local\n", 0600)
+
+	err := pull(environ, pullOptions{})
+	if err == nil || !strings.Contains(err.Error(), "app.conf (keys B)") {
+		t.Fatalf("expected a key conflict on B, got %v", err)
+	}
+
+	if err := pull(environ, pullOptions{markers: true}); err != nil {
+		t.Fatalf("pull -markers returned error: %v", err)
+	}
+	ref := strings.TrimSpace(readFile(t, environ.Ref))
+	expected := "A=remote\n<<<<<<< local\nB=local\n=======\nB=remote\n>>>>>>> " + ref + "\n"
+	if content := readFile(t, "app.conf"); content != expected {
+		t.Fatalf("unexpected content after pull -markers:\n%s", content)
+	}
+}
+
+func TestPullPruneRemovesOnlyUndeclaredFiles(t *testing.T) {
+	environ := testEnviron(t, "a.txt", "moved.txt", "dropped.txt")
+	for _, name := range environ.Files {
+		writeFile(t, name, name+"\n", 0600)
+	}
+	if err := push(environ); err != nil {
+		t.Fatalf("push returned error: %v", err)
+	}
+
+	// moved.txt now belongs to another environ, dropped.txt to none
+	environ.Files = []string{"a.txt"}
+	other := Environ{Name: "other", Files: []string{"moved.txt"}}
+	environs[environ.Name], environs[other.Name] = environ, other
+	t.Cleanup(func() {
+		delete(environs, environ.Name)
+		delete(environs, other.Name)
+	})
+	pushElsewhere(t, environ, map[string]string{"a.txt": "a.txt\n"})
+
+	if err := pull(environ, pullOptions{prune: true}); err != nil {
+		t.Fatalf("pull -prune returned error: %v", err)
+	}
+	if _, err := os.Stat("dropped.txt"); !os.IsNotExist(err) {
+		t.Fatalf("expected dropped.txt to be pruned, got %v", err)
+	}
+	if content := readFile(t, "moved.txt"); content != "moved.txt\n" {
+		t.Fatalf("expected moved.txt to be kept for the environ it moved to, got %q", content)
+	}
+}
+
+func TestPullOutsideGitOverwritesFiles(t *testing.T) {
+	dir := t.TempDir()
+	t.Chdir(dir)
+	t.Setenv("GIT_CEILING_DIRECTORIES", filepath.Dir(dir))
+	environ := Environ{
+		Remote: memoryRemote{},
+		Name:   "test",
+		Files:  []string{"secrets.txt"},
+		Ref:    "environ.hash",
+		Mode:   defaultMode,
+	}
+	pushElsewhere(t, environ, map[string]string{"secrets.txt": "remote\n"})
+	writeFile(t, "secrets.txt", "stale\n", 0600)
+
+	if err := pull(environ, pullOptions{}); err != nil {
+		t.Fatalf("pull returned error: %v", err)
+	}
+	if content := readFile(t, "secrets.txt"); content != "remote\n" {
+		t.Fatalf("expected secrets.txt to be overwritten, got %q", content)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"log"
+)
+
+// rekeyArchiveIDs lists the archives to rewrite: every archive the ref file
+// ever pointed to, plus its current uncommitted content
+func rekeyArchiveIDs(environ Environ) ([]string, error) {
+	archiveIDs, err := refHistory(environ.Ref)
+	if err != nil {
+		return nil, err
+	}
+	if current, err := readRefFile(environ.Ref); err == nil {
+		for _, archiveID := range archiveIDs {
+			if archiveID == current {
+				return archiveIDs, nil
+			}
+		}
+		archiveIDs = append([]string{current}, archiveIDs...)
+	}
+	return archiveIDs, nil
+}
+
+// rekey downloads each archive through the environ's remote and writes it
+// back, so that encrypting remotes re-encrypt it for their current keys
+func rekey(environ Environ, archiveIDs []string) error {
+	if len(archiveIDs) == 0 {
+		var err error
+		archiveIDs, err = rekeyArchiveIDs(environ)
+		if err != nil {
+			return fmt.Errorf("failed to list archives from the history of %s: %w", environ.Ref, err)
+		}
+	}
+
+	rewritten := 0
+	var failed []string
+	for _, archiveID := range archiveIDs {
+		zipData, err := environ.Remote.Get(archiveID)
+		if err != nil {
+			log.Printf("Failed to download %s: %s", archiveID, err)
+			failed = append(failed, archiveID)
+			continue
+		}
+		if err := verifyArchive(archiveID, zipData); err != nil {
+			log.Printf("Failed to verify %s: %s", archiveID, err)
+			failed = append(failed, archiveID)
+			continue
+		}
+		if err := overwrite(environ.Remote, archiveID, zipData); err != nil {
+			log.Printf("Failed to rewrite %s: %s", archiveID, err)
+			failed = append(failed, archiveID)
+			continue
+		}
+		// Signatures go through the same remote, so they must stay readable too
+		var signatureErr error
+		for _, key := range signatureKeys(environ, archiveID) {
+			if signature, err := environ.Remote.Get(key); err == nil {
+				if err := overwrite(environ.Remote, key, signature); err != nil && signatureErr == nil {
+					signatureErr = err
+				}
+			}
+		}
+		if signatureErr != nil {
+			log.Printf("Failed to rewrite the signatures of %s: %s", archiveID, signatureErr)
+			failed = append(failed, archiveID)
+			continue
+		}
+		log.Printf("Rewrote %s", archiveID)
+		rewritten++
+	}
+
+	log.Printf("Rewrote %d/%d archives in %s", rewritten, len(archiveIDs), environ.String())
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to rewrite %d archives: %v", len(failed), failed)
+	}
+	return nil
+}
+
+func rekeyAll(environNames []string, archiveIDs []string) error {
+	for _, environName := range environNames {
+		environ, ok := environs[environName]
+		if !ok {
+			return envNotFound(environName)
+		}
+		if err := rekey(environ, archiveIDs); err != nil {
+			return fmt.Errorf("failed to rekey %s: %w", environName, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestRekeyArchiveIDsWalksRefHistory(t *testing.T) {
+	t.Chdir(t.TempDir())
+	initGitRepo(t)
+	first := generateArchiveID([]byte("first"))
+	second := generateArchiveID([]byte("second"))
+	current := generateArchiveID([]byte("current"))
+	commitFile(t, "environ.hash", first)
+	commitFile(t, "environ.hash", second)
+	// Reverted, so first must only be listed once
+	commitFile(t, "environ.hash", first)
+	if _, err := runGit("rm", "-q", "environ.hash"); err != nil {
+		t.Fatalf("git rm failed: %v", err)
+	}
+	if _, err := runGit("commit", "-q", "-m", "remove"); err != nil {
+		t.Fatalf("git commit failed: %v", err)
+	}
+	if err := os.WriteFile("environ.hash", []byte(current), 0644); err != nil {
+		t.Fatalf("failed to write ref: %v", err)
+	}
+
+	archiveIDs, err := rekeyArchiveIDs(Environ{Ref: "environ.hash"})
+	if err != nil {
+		t.Fatalf("rekeyArchiveIDs returned error: %v", err)
+	}
+	if want := []string{current, first, second}; !reflect.DeepEqual(archiveIDs, want) {
+		t.Fatalf("expected %v, got %v", want, archiveIDs)
+	}
+}
+
+func TestRekeyRewritesArchivesUnderNewKey(t *testing.T) {
+	t.Chdir(t.TempDir())
+	initGitRepo(t)
+	oldKey, newKey := filepath.Join(t.TempDir(), "kek.old"), filepath.Join(t.TempDir(), "kek")
+	writeTestKey(t, oldKey)
+	writeTestKey(t, newKey)
+
+	inner := memoryRemote{}
+	before := Encrypted{Of: inner, Key: FileKey{path: oldKey}}
+	archives := map[string][]byte{}
+	for _, content := range []string{"SECRET=first\n", "SECRET=second\n"} {
+		archive := zipData(t, map[string]string{".env": content})
+		archiveID := generateArchiveID(archive)
+		archives[archiveID] = archive
+		if err := before.Write(archiveID, archive); err != nil {
+			t.Fatalf("Write returned error: %v", err)
+		}
+		commitFile(t, "environ.hash", archiveID)
+	}
+	stored := map[string][]byte{}
+	for archiveID := range archives {
+		stored[archiveID] = inner[archiveID]
+	}
+
+	environ := Environ{
+		Remote: Encrypted{Of: inner, Key: FileKey{path: newKey, previous: []string{oldKey}}},
+		Ref:    "environ.hash",
+	}
+	var only string
+	for archiveID := range archives {
+		only = archiveID
+		break
+	}
+	if err := rekey(environ, []string{only}); err != nil {
+		t.Fatalf("rekey with -ids returned error: %v", err)
+	}
+	for archiveID := range archives {
+		if rewritten := !bytes.Equal(inner[archiveID], stored[archiveID]); rewritten != (archiveID == only) {
+			t.Fatalf("expected only %s to be rewritten, %s rewritten: %v", only, archiveID, rewritten)
+		}
+	}
+
+	if err := rekey(environ, nil); err != nil {
+		t.Fatalf("rekey returned error: %v", err)
+	}
+	withoutOld := Encrypted{Of: inner, Key: FileKey{path: newKey}}
+	for archiveID, archive := range archives {
+		content, err := withoutOld.Get(archiveID)
+		if err != nil || !bytes.Equal(content, archive) {
+			t.Fatalf("expected %s to be readable with the new key only, got %v", archiveID, err)
+		}
+	}
+}
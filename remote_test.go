@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+// testRemote checks what every remote must do: Write never replaces an
+// existing key, Overwrite does, and missing keys are reported as not found
+func testRemote(t *testing.T, remote Remote) {
+	t.Helper()
+	if _, err := remote.Get("missing"); !isNotFound(err) {
+		t.Fatalf("expected not found, got %v", err)
+	}
+	exister, canCheck := remote.(Exister)
+	if canCheck {
+		if exists, err := exister.Exists("missing"); err != nil || exists {
+			t.Fatalf("expected missing key not to exist, got %v (%v)", exists, err)
+		}
+	}
+
+	if err := remote.Write("id", []byte("first\x00")); err != nil {
+		t.Fatalf("Write returned error: %v", err)
+	}
+	if err := remote.Write("id", []byte("second")); err != nil {
+		t.Fatalf("second Write returned error: %v", err)
+	}
+	content, err := remote.Get("id")
+	if err != nil || string(content) != "first\x00" {
+		t.Fatalf("expected first content to be kept, got %q (%v)", content, err)
+	}
+	if canCheck {
+		if exists, err := exister.Exists("id"); err != nil || !exists {
+			t.Fatalf("expected written key to exist, got %v (%v)", exists, err)
+		}
+	}
+
+	if err := overwrite(remote, "id", []byte("second")); err != nil {
+		t.Fatalf("Overwrite returned error: %v", err)
+	}
+	if content, err := remote.Get("id"); err != nil || string(content) != "second" {
+		t.Fatalf("expected Overwrite to replace content, got %q (%v)", content, err)
+	}
+}
+
+// TestRemoteConformance runs testRemote against a fake of each remote
+// storing archives elsewhere than on this machine
+func TestRemoteConformance(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		remote func(t *testing.T) Remote
+	}{
+		{"http", func(t *testing.T) Remote {
+			server, _ := fakeServer(t, "")
+			return HTTP{url: server.URL + "/environ", client: server.Client()}
+		}},
+		{"sftp", func(t *testing.T) Remote {
+			return fakeSFTP(t)
+		}},
+		{"git", func(t *testing.T) Remote {
+			a, _ := gitClones(t)
+			return Git{repo: a, ref: "refs/environ/archives", remote: "origin"}
+		}},
+		{"azblob", func(t *testing.T) Remote {
+			server, _ := fakeAzBlob(t, http.StatusConflict, "BlobAlreadyExists")
+			return newFakeAzBlob(t, server)
+		}},
+		{"vault", func(t *testing.T) Remote {
+			t.Setenv("VAULT_TOKEN", "s.token")
+			server, _ := fakeVault(t, "s.token")
+			return Vault{addr: server.URL, mount: "secret", path: "environ", client: server.Client()}
+		}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			testRemote(t, test.remote(t))
+		})
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"strings"
@@ -9,6 +10,7 @@ import (
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"go.starlark.net/starlark"
 )
 
@@ -66,6 +68,19 @@ func (s S3) Get(key string) ([]byte, error) {
 	return body, nil
 }
 
+func (s S3) Exists(key string) (bool, error) {
+	_, err := s.client.HeadObject(context.Background(), &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.prefix + "/" + key),
+	})
+	// HEAD responses have no body, hence no NoSuchKey
+	var notFound *types.NotFound
+	if errors.As(err, &notFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
 func realS3WriteError(err error) bool {
 	return err != nil && !strings.Contains(err.Error(), "PreconditionFailed")
 }
@@ -83,6 +98,15 @@ func (s S3) Write(key string, value []byte) error {
 	return nil
 }
 
+func (s S3) Overwrite(key string, value []byte) error {
+	_, err := s.client.PutObject(context.Background(), &s3.PutObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.prefix + "/" + key),
+		Body:   strings.NewReader(string(value)),
+	})
+	return err
+}
+
 func (s S3) String() string {
 	return fmt.Sprintf("s3(%s, %s)", s.bucket, s.prefix)
 }
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/kevinburke/ssh_config"
+	"github.com/pkg/sftp"
+	"go.starlark.net/starlark"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// Keys tried when neither identity nor ~/.ssh/config name one, like ssh does
+var defaultIdentities = []string{"~/.ssh/id_ed25519", "~/.ssh/id_ecdsa", "~/.ssh/id_rsa"}
+
+func sftpfunc(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	host := ""
+	dir := ""
+	user := ""
+	identity := ""
+	if err := starlark.UnpackArgs(fn.Name(), args, kwargs, "host", &host, "path", &dir, "user?", &user, "identity?", &identity); err != nil {
+		return nil, err
+	}
+	if dir == "" {
+		return nil, fmt.Errorf("%s: path is empty", fn.Name())
+	}
+	return SFTP{
+		host:     host,
+		path:     dir,
+		user:     user,
+		identity: expandHome(identity),
+		conn:     &sftpConn{},
+	}, nil
+}
+
+// SFTP stores archives in a directory on a server over SSH. Host, user, port
+// and keys come from ~/.ssh/config unless given, and the host key must be in
+// known_hosts. The connection is only made on first use.
+type SFTP struct {
+	host     string
+	path     string
+	user     string
+	identity string
+	conn     *sftpConn
+}
+
+type sftpConn struct {
+	once   sync.Once
+	client *sftp.Client
+	err    error
+}
+
+func (s SFTP) client() (*sftp.Client, error) {
+	s.conn.once.Do(func() {
+		s.conn.client, s.conn.err = s.dial()
+		if s.conn.err != nil {
+			s.conn.err = fmt.Errorf("failed to connect to %s: %w", s.host, s.conn.err)
+		}
+	})
+	return s.conn.client, s.conn.err
+}
+
+func (s SFTP) dial() (*sftp.Client, error) {
+	hostName := ssh_config.Get(s.host, "HostName")
+	if hostName == "" {
+		hostName = s.host
+	}
+	user := s.user
+	if user == "" {
+		user = ssh_config.Get(s.host, "User")
+	}
+	if user == "" {
+		user = os.Getenv("USER")
+	}
+	hostKeyCallback, err := s.hostKeyCallback()
+	if err != nil {
+		return nil, err
+	}
+	auth, err := s.auth()
+	if err != nil {
+		return nil, err
+	}
+	sshClient, err := ssh.Dial("tcp", net.JoinHostPort(hostName, ssh_config.Get(s.host, "Port")), &ssh.ClientConfig{
+		User:            user,
+		Auth:            auth,
+		HostKeyCallback: hostKeyCallback,
+	})
+	if err != nil {
+		return nil, err
+	}
+	client, err := sftp.NewClient(sshClient)
+	if err != nil {
+		sshClient.Close()
+		return nil, err
+	}
+	return client, nil
+}
+
+func (s SFTP) hostKeyCallback() (ssh.HostKeyCallback, error) {
+	var files []string
+	for _, file := range strings.Fields(ssh_config.Get(s.host, "UserKnownHostsFile")) {
+		file = expandHome(file)
+		if _, err := os.Stat(file); err == nil {
+			files = append(files, file)
+		}
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no known_hosts file, connect once with ssh to add the host key of %s", s.host)
+	}
+	return knownhosts.New(files...)
+}
+
+// auth offers the keys of the SSH agent, then those of identity files
+func (s SFTP) auth() ([]ssh.AuthMethod, error) {
+	var methods []ssh.AuthMethod
+	if socket := os.Getenv("SSH_AUTH_SOCK"); socket != "" && s.identity == "" {
+		if agentConn, err := net.Dial("unix", socket); err == nil {
+			methods = append(methods, ssh.PublicKeysCallback(agent.NewClient(agentConn).Signers))
+		}
+	}
+
+	var identities []string
+	if s.identity != "" {
+		identities = []string{s.identity}
+	} else {
+		identities = append(ssh_config.GetAll(s.host, "IdentityFile"), defaultIdentities...)
+	}
+	var signers []ssh.Signer
+	for _, identity := range identities {
+		content, err := os.ReadFile(expandHome(identity))
+		if os.IsNotExist(err) && s.identity == "" {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read identity %s: %w", identity, err)
+		}
+		signer, err := ssh.ParsePrivateKey(content)
+		var passphraseMissing *ssh.PassphraseMissingError
+		if errors.As(err, &passphraseMissing) && s.identity == "" {
+			// Only usable through the agent
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse identity %s: %w", identity, err)
+		}
+		signers = append(signers, signer)
+	}
+	if len(signers) > 0 {
+		methods = append(methods, ssh.PublicKeys(signers...))
+	}
+	if len(methods) == 0 {
+		return nil, fmt.Errorf("no SSH agent or identity file for %s", s.host)
+	}
+	return methods, nil
+}
+
+func (s SFTP) Get(key string) ([]byte, error) {
+	client, err := s.client()
+	if err != nil {
+		return []byte{}, err
+	}
+	file, err := client.Open(path.Join(s.path, key))
+	if err != nil {
+		return []byte{}, err
+	}
+	defer file.Close()
+	body, err := io.ReadAll(file)
+	if err != nil {
+		return []byte{}, err
+	}
+	return body, nil
+}
+
+func (s SFTP) Exists(key string) (bool, error) {
+	client, err := s.client()
+	if err != nil {
+		return false, err
+	}
+	_, err = client.Stat(path.Join(s.path, key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// upload writes value to a temporary file next to key and returns its path
+func (s SFTP) upload(client *sftp.Client, key string, value []byte) (string, error) {
+	if err := client.MkdirAll(s.path); err != nil {
+		return "", err
+	}
+	suffix := make([]byte, 8)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", err
+	}
+	tmp := path.Join(s.path, "."+key+".tmp-"+hex.EncodeToString(suffix))
+	file, err := client.Create(tmp)
+	if err != nil {
+		return "", err
+	}
+	if _, err := file.Write(value); err != nil {
+		file.Close()
+		client.Remove(tmp)
+		return "", err
+	}
+	if err := file.Close(); err != nil {
+		client.Remove(tmp)
+		return "", err
+	}
+	return tmp, nil
+}
+
+func (s SFTP) Write(key string, value []byte) error {
+	client, err := s.client()
+	if err != nil {
+		return err
+	}
+	tmp, err := s.upload(client, key, value)
+	if err != nil {
+		return err
+	}
+	// SFTP renames fail if the target exists
+	target := path.Join(s.path, key)
+	if err := client.Rename(tmp, target); err != nil {
+		client.Remove(tmp)
+		if _, statErr := client.Stat(target); statErr == nil {
+			// Already there
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+func (s SFTP) Overwrite(key string, value []byte) error {
+	client, err := s.client()
+	if err != nil {
+		return err
+	}
+	tmp, err := s.upload(client, key, value)
+	if err != nil {
+		return err
+	}
+	if err := client.PosixRename(tmp, path.Join(s.path, key)); err != nil {
+		client.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+func (s SFTP) String() string {
+	if s.user != "" {
+		return fmt.Sprintf("sftp(%s@%s, %s)", s.user, s.host, s.path)
+	}
+	return fmt.Sprintf("sftp(%s, %s)", s.host, s.path)
+}
+
+func (s SFTP) Type() string {
+	return "SFTP"
+}
+
+func (s SFTP) Freeze() {
+}
+
+func (s SFTP) Truth() starlark.Bool {
+	return starlark.Bool(true)
+}
+
+func (s SFTP) Hash() (uint32, error) {
+	return starlark.String(s.String()).Hash()
+}
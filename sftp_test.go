@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/pkg/sftp"
+)
+
+// fakeSFTP returns a remote backed by an in-memory SFTP server
+func fakeSFTP(t *testing.T) SFTP {
+	t.Helper()
+	serverConn, clientConn := net.Pipe()
+	server := sftp.NewRequestServer(serverConn, sftp.InMemHandler())
+	go server.Serve()
+	client, err := sftp.NewClientPipe(clientConn, clientConn)
+	if err != nil {
+		t.Fatalf("failed to start SFTP client: %v", err)
+	}
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	conn := &sftpConn{client: client}
+	conn.once.Do(func() {})
+	return SFTP{host: "fake", path: "/srv/environ", conn: conn}
+}
+
+func TestSFTPWriteLeavesNoTemporaryFiles(t *testing.T) {
+	remote := fakeSFTP(t)
+	for _, content := range []string{"first", "second"} {
+		if err := remote.Write("id", []byte(content)); err != nil {
+			t.Fatalf("Write returned error: %v", err)
+		}
+	}
+	if err := remote.Overwrite("id", []byte("third")); err != nil {
+		t.Fatalf("Overwrite returned error: %v", err)
+	}
+
+	entries, err := remote.conn.client.ReadDir("/srv/environ")
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("expected only the archive to be left, got %d entries (%v)", len(entries), err)
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"strings"
+)
+
+const signatureAlgorithm = "ed25519"
+
+// signatureKey is where a signer's signature of an archive is stored, next
+// to it in the remote. Each signer has its own, so that nobody else's
+// signature, stale or planted, can take its place.
+func signatureKey(archiveID string, publicKey ed25519.PublicKey) string {
+	return archiveID + "." + keyID(publicKey) + ".sig"
+}
+
+// legacySignatureKey is where signatures were stored before they were kept per signer
+func legacySignatureKey(archiveID string) string {
+	return archiveID + ".sig"
+}
+
+// signatureKeys lists where signatures of an archive may be stored: for each
+// trusted signer and the environ's own signing key, then the legacy key
+func signatureKeys(environ Environ, archiveID string) []string {
+	var keys []string
+	for _, publicKey := range environ.TrustedSigners {
+		keys = append(keys, signatureKey(archiveID, publicKey))
+	}
+	if environ.SigningKey != "" {
+		if seed, err := readKeyFile(environ.SigningKey); err == nil {
+			publicKey := ed25519.NewKeyFromSeed(seed).Public().(ed25519.PublicKey)
+			if !isTrusted(environ, publicKey) {
+				keys = append(keys, signatureKey(archiveID, publicKey))
+			}
+		}
+	}
+	return append(keys, legacySignatureKey(archiveID))
+}
+
+func parsePublicKey(s string) (ed25519.PublicKey, error) {
+	decoded, err := base64.StdEncoding.DecodeString(s)
+	if err != nil || len(decoded) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("%q is not a base64-encoded ed25519 public key", s)
+	}
+	return ed25519.PublicKey(decoded), nil
+}
+
+func encodePublicKey(publicKey ed25519.PublicKey) string {
+	return base64.StdEncoding.EncodeToString(publicKey)
+}
+
+func isTrusted(environ Environ, publicKey ed25519.PublicKey) bool {
+	for _, trusted := range environ.TrustedSigners {
+		if trusted.Equal(publicKey) {
+			return true
+		}
+	}
+	return false
+}
+
+// signArchive signs the archive with the environ's signing key, created on
+// first use, and stores the signature next to the archive unless it is
+// already there
+func signArchive(environ Environ, archiveID string, zipData []byte) error {
+	_, statErr := os.Stat(environ.SigningKey)
+	seed, err := loadOrCreateKeyFile(environ.SigningKey)
+	if err != nil {
+		return fmt.Errorf("failed to load signing key: %w", err)
+	}
+	privateKey := ed25519.NewKeyFromSeed(seed)
+	publicKey := privateKey.Public().(ed25519.PublicKey)
+	if errors.Is(statErr, fs.ErrNotExist) {
+		log.Printf("Created signing key %s with public key %s", environ.SigningKey, encodePublicKey(publicKey))
+	}
+	if len(environ.TrustedSigners) > 0 && !isTrusted(environ, publicKey) {
+		log.Printf("Warning: signing key %s is not in trusted_signers, pulls will reject %s", encodePublicKey(publicKey), archiveID)
+	}
+
+	key := signatureKey(archiveID, publicKey)
+	signature := []byte(fmt.Sprintf("%s %s %s\n", signatureAlgorithm, encodePublicKey(publicKey), base64.StdEncoding.EncodeToString(ed25519.Sign(privateKey, zipData))))
+	if existing, err := environ.Remote.Get(key); err == nil && bytes.Equal(existing, signature) {
+		return nil
+	}
+	// ed25519 signatures are deterministic, so overwriting only ever replaces
+	// a signature that is not ours
+	if err := overwrite(environ.Remote, key, signature); err != nil {
+		return fmt.Errorf("failed to upload signature: %w", err)
+	}
+	return nil
+}
+
+// verifySignature checks that the archive was signed by one of the environ's trusted signers
+func verifySignature(environ Environ, archiveID string, zipData []byte) error {
+	if len(environ.TrustedSigners) == 0 {
+		return nil
+	}
+	var errs []error
+	for _, publicKey := range environ.TrustedSigners {
+		err := verifySignatureAt(environ, archiveID, zipData, signatureKey(archiveID, publicKey))
+		if err == nil {
+			return nil
+		}
+		if !isNotFound(err) {
+			errs = append(errs, err)
+		}
+	}
+	// Archives signed before signatures were kept per signer
+	err := verifySignatureAt(environ, archiveID, zipData, legacySignatureKey(archiveID))
+	if err == nil {
+		return nil
+	}
+	if !isNotFound(err) {
+		errs = append(errs, err)
+	}
+	if len(errs) == 0 {
+		return fmt.Errorf("archive %s is not signed by a trusted signer", archiveID)
+	}
+	return errors.Join(errs...)
+}
+
+// verifySignatureAt checks the signature stored at key
+func verifySignatureAt(environ Environ, archiveID string, zipData []byte, key string) error {
+	content, err := environ.Remote.Get(key)
+	if err != nil {
+		return err
+	}
+	fields := strings.Fields(string(bytes.TrimSpace(content)))
+	if len(fields) != 3 || fields[0] != signatureAlgorithm {
+		return fmt.Errorf("invalid signature for archive %s", archiveID)
+	}
+	publicKey, err := parsePublicKey(fields[1])
+	if err != nil {
+		return fmt.Errorf("invalid signature for archive %s: %w", archiveID, err)
+	}
+	if !isTrusted(environ, publicKey) {
+		return fmt.Errorf("archive %s is signed by %s, which is not a trusted signer", archiveID, fields[1])
+	}
+	signature, err := base64.StdEncoding.DecodeString(fields[2])
+	if err != nil || !ed25519.Verify(publicKey, zipData, signature) {
+		return fmt.Errorf("signature of archive %s by %s does not match its content", archiveID, fields[1])
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSignedArchiveVerification(t *testing.T) {
+	environ := Environ{
+		Remote:     memoryRemote{},
+		SigningKey: filepath.Join(t.TempDir(), "signing.key"),
+	}
+	archive := zipData(t, map[string]string{".env": "SECRET=value\n"})
+	archiveID := generateArchiveID(archive)
+	if err := environ.Remote.Write(archiveID, archive); err != nil {
+		t.Fatalf("Write returned error: %v", err)
+	}
+	if err := signArchive(environ, archiveID, archive); err != nil {
+		t.Fatalf("signArchive returned error: %v", err)
+	}
+
+	seed, err := readKeyFile(environ.SigningKey)
+	if err != nil {
+		t.Fatalf("expected signing key to be created: %v", err)
+	}
+	publicKey := ed25519.NewKeyFromSeed(seed).Public().(ed25519.PublicKey)
+
+	otherKey, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	environ.TrustedSigners = []ed25519.PublicKey{otherKey}
+	if _, err := fetchArchive(environ, archiveID); err == nil || !strings.Contains(err.Error(), "not signed by a trusted signer") {
+		t.Fatalf("expected untrusted signer to be rejected, got %v", err)
+	}
+
+	environ.TrustedSigners = []ed25519.PublicKey{publicKey}
+	if _, err := fetchArchive(environ, archiveID); err != nil {
+		t.Fatalf("expected trusted signature to verify, got %v", err)
+	}
+
+	tampered := zipData(t, map[string]string{".env": "SECRET=evil\n"})
+	environ.Remote.(memoryRemote)[archiveID] = tampered
+	if _, err := fetchArchive(environ, archiveID); err == nil {
+		t.Fatalf("expected tampered archive to be rejected")
+	}
+}
+
+func TestSignArchiveReplacesPlantedSignature(t *testing.T) {
+	environ := Environ{
+		Remote:     memoryRemote{},
+		SigningKey: filepath.Join(t.TempDir(), "signing.key"),
+	}
+	archive := zipData(t, map[string]string{".env": "SECRET=value\n"})
+	archiveID := generateArchiveID(archive)
+	seed, err := loadOrCreateKeyFile(environ.SigningKey)
+	if err != nil {
+		t.Fatalf("failed to create signing key: %v", err)
+	}
+	publicKey := ed25519.NewKeyFromSeed(seed).Public().(ed25519.PublicKey)
+	otherKey, otherPrivateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	environ.TrustedSigners = []ed25519.PublicKey{otherKey, publicKey}
+
+	// Planted before the push, under our key and the legacy key
+	remote := environ.Remote.(memoryRemote)
+	remote[archiveID] = archive
+	planted := []byte("ed25519 " + encodePublicKey(otherKey) + " " + base64.StdEncoding.EncodeToString(ed25519.Sign(otherPrivateKey, []byte("other"))) + "\n")
+	remote[signatureKey(archiveID, publicKey)] = planted
+	remote[legacySignatureKey(archiveID)] = planted
+	if _, err := fetchArchive(environ, archiveID); err == nil {
+		t.Fatalf("expected planted signatures to be rejected")
+	}
+
+	if err := signArchive(environ, archiveID, archive); err != nil {
+		t.Fatalf("signArchive returned error: %v", err)
+	}
+	if _, err := fetchArchive(environ, archiveID); err != nil {
+		t.Fatalf("expected our signature to replace the planted one, got %v", err)
+	}
+}
+
+func TestPushSignsArchiveAlreadyUpToDate(t *testing.T) {
+	environ := testEnviron(t, ".env")
+	writeFile(t, ".env", "SECRET=value\n", 0600)
+	if err := push(environ); err != nil {
+		t.Fatalf("push returned error: %v", err)
+	}
+
+	environ.SigningKey = filepath.Join(t.TempDir(), "signing.key")
+	var output bytes.Buffer
+	log.SetOutput(&output)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	if err := push(environ); err != nil {
+		t.Fatalf("push returned error: %v", err)
+	}
+	seed, err := readKeyFile(environ.SigningKey)
+	if err != nil {
+		t.Fatalf("expected signing key to be created: %v", err)
+	}
+	publicKey := ed25519.NewKeyFromSeed(seed).Public().(ed25519.PublicKey)
+	if !strings.Contains(output.String(), encodePublicKey(publicKey)) {
+		t.Fatalf("expected the new public key to be printed, got %q", output.String())
+	}
+
+	environ.TrustedSigners = []ed25519.PublicKey{publicKey}
+	archiveID := readFile(t, environ.Ref)
+	if _, err := fetchArchive(environ, archiveID); err != nil {
+		t.Fatalf("expected the up to date archive to be signed, got %v", err)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// syncState records the working tree as of the last pull or push of an environ,
+// so that local edits made since can be told apart from stale files
+type syncState struct {
+	ArchiveID string `json:"archive_id"`
+	// Files maps each file to the hash of its content, as generateArchiveID
+	Files map[string]string `json:"files"`
+	// untracked is set outside of a git repository, where no state is kept
+	untracked bool
+}
+
+// stateDir is where sync states are kept, inside the git directory so they
+// are neither committed nor shared between worktrees
+func stateDir() (string, bool) {
+	out, err := runGit("rev-parse", "--git-path", "environ")
+	if err != nil {
+		return "", false
+	}
+	return strings.TrimSpace(out), true
+}
+
+func statePath(environName string) (string, bool) {
+	dir, ok := stateDir()
+	if !ok {
+		return "", false
+	}
+	return filepath.Join(dir, url.PathEscape(environName)+".json"), true
+}
+
+// loadState returns an empty state when the environ was never synced, or
+// outside of a git repository
+func loadState(environName string) (syncState, error) {
+	state := syncState{Files: map[string]string{}}
+	path, ok := statePath(environName)
+	if !ok {
+		state.untracked = true
+		return state, nil
+	}
+	content, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return state, fmt.Errorf("failed to read sync state: %w", err)
+	}
+	if err := json.Unmarshal(content, &state); err != nil {
+		return state, fmt.Errorf("failed to parse sync state %s: %w", path, err)
+	}
+	if state.Files == nil {
+		state.Files = map[string]string{}
+	}
+	return state, nil
+}
+
+func saveState(environName string, state syncState) error {
+	path, ok := statePath(environName)
+	if !ok {
+		return nil
+	}
+	content, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("failed to create %s: %w", filepath.Dir(path), err)
+	}
+	tmp, err := writeTemp(path, content, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to write sync state: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write sync state: %w", err)
+	}
+	return nil
+}
+
+// zipFileHashes hashes the content of each file in an archive
+func zipFileHashes(zipData []byte) (map[string]string, error) {
+	zipReader, err := zip.NewReader(bytes.NewReader(zipData), int64(len(zipData)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read ZIP: %w", err)
+	}
+	hashes := make(map[string]string)
+	for _, file := range zipReader.File {
+		content, err := readZipFileContent(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read file %s from ZIP: %w", file.Name, err)
+		}
+		hashes[file.Name] = generateArchiveID(content)
+	}
+	return hashes, nil
+}
+
+// locallyModified reports whether a file was edited since the last sync.
+// Missing files are not modified, but existing files that were never synced
+// are, e.g. on the first pull after upgrading: nothing says they are stale.
+// Outside of a git repository, nothing is ever synced, e.g. in a Docker build
+// context, so files are overwritten as they were before sync states.
+func (s syncState) locallyModified(name string) (bool, error) {
+	if s.untracked {
+		return false, nil
+	}
+	content, err := os.ReadFile(name)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	synced, ok := s.Files[name]
+	if !ok {
+		return true, nil
+	}
+	return generateArchiveID(content) != synced, nil
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sort"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// Exit codes of status, from least to most severe
+const (
+	statusClean        = 0
+	statusLocalChanges = 2
+	statusNotPushed    = 3
+)
+
+// environStatus compares the working tree of an environ with its ref
+type environStatus struct {
+	Environ string `json:"environ"`
+	// Ref is the archive ID in the ref file, empty if there is none
+	Ref      string `json:"ref"`
+	InRemote bool   `json:"in_remote"`
+	// InCache is nil when the remote has no cache
+	InCache *bool `json:"in_cache,omitempty"`
+	// Local is the archive ID of the working files, empty if some are missing
+	Local    string   `json:"local"`
+	Modified []string `json:"modified"`
+	// Missing files are in the environ but not in the working tree
+	Missing []string `json:"missing"`
+	// Extra files are only in one of the environ and the ref
+	Extra []string `json:"extra"`
+}
+
+func (s environStatus) code() int {
+	switch {
+	// A cached archive that isn't in the remote is missing for everyone else
+	case s.Ref == "" || !s.InRemote:
+		return statusNotPushed
+	case s.Local != s.Ref || len(s.Modified) > 0 || len(s.Missing) > 0 || len(s.Extra) > 0:
+		return statusLocalChanges
+	default:
+		return statusClean
+	}
+}
+
+// isNotFound reports whether a Get error means that the key does not exist
+func isNotFound(err error) bool {
+	var noSuchKey *types.NoSuchKey
+	var httpNotFound HTTPNotFound
+	var gitNotFound GitNotFound
+	return errors.Is(err, fs.ErrNotExist) || errors.Is(err, storage.ErrObjectNotExist) || errors.As(err, &noSuchKey) ||
+		bloberror.HasCode(err, bloberror.BlobNotFound) || errors.As(err, &httpNotFound) || errors.As(err, &gitNotFound)
+}
+
+func archiveExists(remote Remote, id string) (bool, error) {
+	if exister, ok := remote.(Exister); ok {
+		exists, err := exister.Exists(id)
+		if err != nil {
+			return false, fmt.Errorf("failed to check for archive %s in %s: %w", id, remote, err)
+		}
+		return exists, nil
+	}
+	_, err := remote.Get(id)
+	if err == nil {
+		return true, nil
+	}
+	if isNotFound(err) {
+		return false, nil
+	}
+	return false, fmt.Errorf("failed to check for archive %s in %s: %w", id, remote, err)
+}
+
+// storageOf returns the remote archives end up in, below any encryption, and
+// the cache in front of it if there is one
+func storageOf(remote Remote) (Remote, Remote) {
+	var origin, cached Remote
+	walkRemotes(remote, func(r Remote) {
+		if c, ok := r.(Cache); ok && cached == nil {
+			origin, cached = c.Of, c.By
+		}
+	})
+	if cached != nil {
+		return unwrapSingle(origin), cached
+	}
+	return unwrapSingle(remote), nil
+}
+
+// unwrapSingle strips the wrappers around remote that have a single child,
+// such as encryption, so that checking for an archive needs no key
+func unwrapSingle(remote Remote) Remote {
+	for {
+		w, ok := remote.(wrapper)
+		if !ok || len(w.Unwrap()) != 1 {
+			return remote
+		}
+		remote = w.Unwrap()[0]
+	}
+}
+
+func status(environ Environ) (environStatus, error) {
+	s := environStatus{Environ: environ.Name, Modified: []string{}, Missing: []string{}, Extra: []string{}}
+
+	if localZip, err := getLocalZipData(environ); err == nil {
+		s.Local = generateArchiveID(localZip)
+	}
+
+	refContent, err := os.ReadFile(environ.Ref)
+	if err != nil && !os.IsNotExist(err) {
+		return s, fmt.Errorf("failed to read ref file %q: %w", environ.Ref, err)
+	}
+	s.Ref = strings.TrimSpace(string(refContent))
+
+	var refFiles map[string][]byte
+	if s.Ref != "" {
+		origin, cached := storageOf(environ.Remote)
+		if s.InRemote, err = archiveExists(origin, s.Ref); err != nil {
+			return s, err
+		}
+		if cached != nil {
+			inCache, err := archiveExists(cached, s.Ref)
+			if err != nil {
+				return s, err
+			}
+			s.InCache = &inCache
+		}
+		if s.InRemote || (s.InCache != nil && *s.InCache) {
+			zipData, err := fetchArchive(environ, s.Ref)
+			if err != nil {
+				return s, err
+			}
+			if refFiles, err = zipContents(zipData); err != nil {
+				return s, err
+			}
+		}
+	}
+
+	inEnviron := make(map[string]bool)
+	for _, name := range environ.Files {
+		inEnviron[name] = true
+		content, err := os.ReadFile(name)
+		if os.IsNotExist(err) {
+			s.Missing = append(s.Missing, name)
+			continue
+		}
+		if err != nil {
+			return s, fmt.Errorf("failed to read %q: %w", name, err)
+		}
+		if refFiles == nil {
+			continue
+		}
+		refContent, ok := refFiles[name]
+		if !ok {
+			s.Extra = append(s.Extra, name)
+		} else if !bytes.Equal(content, refContent) {
+			s.Modified = append(s.Modified, name)
+		}
+	}
+	for name := range refFiles {
+		if inEnviron[name] {
+			continue
+		}
+		// In the ref but no longer in the environ
+		s.Extra = append(s.Extra, name)
+	}
+	sort.Strings(s.Extra)
+	return s, nil
+}
+
+// zipContents reads every file of an archive
+func zipContents(zipData []byte) (map[string][]byte, error) {
+	zipReader, err := zip.NewReader(bytes.NewReader(zipData), int64(len(zipData)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read ZIP: %w", err)
+	}
+	if err := validateZip(zipReader); err != nil {
+		return nil, err
+	}
+	contents := make(map[string][]byte)
+	for _, file := range zipReader.File {
+		content, err := readZipFileContent(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read file %s from ZIP: %w", file.Name, err)
+		}
+		contents[file.Name] = content
+	}
+	return contents, nil
+}
+
+func printStatus(s environStatus) {
+	ref := s.Ref
+	switch {
+	case ref == "":
+		ref = "none"
+	case s.InRemote:
+		ref += " (pushed"
+	default:
+		ref += " (not pushed"
+	}
+	if s.Ref != "" {
+		if s.InCache != nil && *s.InCache {
+			ref += ", cached)"
+		} else if s.InCache != nil {
+			ref += ", not cached)"
+		} else {
+			ref += ")"
+		}
+	}
+	local := s.Local
+	if local == "" {
+		local = "incomplete"
+	}
+	fmt.Printf("%s: ref %s, local %s\n", s.Environ, ref, local)
+	for _, list := range []struct {
+		label string
+		names []string
+	}{{"modified", s.Modified}, {"missing", s.Missing}, {"extra", s.Extra}} {
+		if len(list.names) > 0 {
+			fmt.Printf("  %s: %s\n", list.label, strings.Join(list.names, ", "))
+		}
+	}
+}
+
+// statusAll prints the status of each environ and returns the most severe exit code
+func statusAll(environNames []string, asJSON bool) (int, error) {
+	code := statusClean
+	var statuses []environStatus
+	for _, environName := range environNames {
+		environ, ok := environs[environName]
+		if !ok {
+			return code, envNotFound(environName)
+		}
+		s, err := status(environ)
+		if err != nil {
+			return code, fmt.Errorf("failed to get status of %s: %w", environName, err)
+		}
+		code = max(code, s.code())
+		if asJSON {
+			statuses = append(statuses, s)
+		} else {
+			printStatus(s)
+		}
+	}
+	if asJSON {
+		out, err := json.MarshalIndent(statuses, "", "  ")
+		if err != nil {
+			return code, err
+		}
+		fmt.Println(string(out))
+	}
+	return code, nil
+}
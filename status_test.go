@@ -0,0 +1,96 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestStatusComparesWorkingFilesWithRef(t *testing.T) {
+	t.Chdir(t.TempDir())
+	archive := zipData(t, map[string]string{".env": "A=1\n", ".env.old": "B=1\n"})
+	archiveID := generateArchiveID(archive)
+	if err := os.WriteFile("environ.hash", []byte(archiveID), 0644); err != nil {
+		t.Fatalf("failed to write ref: %v", err)
+	}
+	if err := os.WriteFile(".env", []byte("A=2\n"), 0600); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	if err := os.WriteFile(".env.new", []byte("C=1\n"), 0600); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	environ := Environ{
+		Remote: Cache{By: Local{path: t.TempDir()}, Of: memoryRemote{archiveID: archive}},
+		Name:   "test",
+		Files:  []string{".env", ".env.new"},
+		Ref:    "environ.hash",
+		Mode:   defaultMode,
+	}
+
+	s, err := status(environ)
+	if err != nil {
+		t.Fatalf("status returned error: %v", err)
+	}
+	if !s.InRemote || s.InCache == nil || *s.InCache {
+		t.Fatalf("expected archive in remote but not in cache, got %+v", s)
+	}
+	if !reflect.DeepEqual(s.Modified, []string{".env"}) || !reflect.DeepEqual(s.Extra, []string{".env.new", ".env.old"}) || len(s.Missing) > 0 {
+		t.Fatalf("unexpected file status %+v", s)
+	}
+	if s.code() != statusLocalChanges {
+		t.Fatalf("expected exit code %d, got %d", statusLocalChanges, s.code())
+	}
+
+	if err := os.WriteFile("environ.hash", []byte(s.Local), 0644); err != nil {
+		t.Fatalf("failed to write ref: %v", err)
+	}
+	if s, err = status(environ); err != nil {
+		t.Fatalf("status returned error: %v", err)
+	}
+	if s.code() != statusNotPushed {
+		t.Fatalf("expected exit code %d, got %d", statusNotPushed, s.code())
+	}
+}
+
+func TestStatusOnlyCountsArchivesInTheRemoteAsPushed(t *testing.T) {
+	t.Chdir(t.TempDir())
+	archive := zipData(t, map[string]string{".env": "A=1\n"})
+	archiveID := generateArchiveID(archive)
+	cache := Local{path: t.TempDir()}
+	if err := cache.Write(archiveID, archive); err != nil {
+		t.Fatalf("failed to cache archive: %v", err)
+	}
+	if err := os.WriteFile("environ.hash", []byte(archiveID), 0644); err != nil {
+		t.Fatalf("failed to write ref: %v", err)
+	}
+	if err := os.WriteFile(".env", []byte("A=1\n"), 0600); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	environ := Environ{
+		Remote: Cache{By: cache, Of: memoryRemote{}},
+		Name:   "test",
+		Files:  []string{".env"},
+		Ref:    "environ.hash",
+		Mode:   defaultMode,
+	}
+
+	s, err := status(environ)
+	if err != nil {
+		t.Fatalf("status returned error: %v", err)
+	}
+	if s.InRemote || s.InCache == nil || !*s.InCache {
+		t.Fatalf("expected archive in cache only, got %+v", s)
+	}
+	if s.code() != statusNotPushed {
+		t.Fatalf("expected exit code %d, got %d", statusNotPushed, s.code())
+	}
+}
+
+func TestStorageOfUnwrapsEncryptionBelowCache(t *testing.T) {
+	storage := Local{path: t.TempDir()}
+	cache := Local{path: t.TempDir()}
+	origin, cached := storageOf(Cache{Of: Age{Of: storage}, By: cache})
+	if origin != storage || cached != cache {
+		t.Fatalf("expected %v cached by %v, got %v cached by %v", storage, cache, origin, cached)
+	}
+}
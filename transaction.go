@@ -0,0 +1,260 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// stagedFile is a file written next to its destination, waiting to be renamed
+// over it, or a file to remove if tmp is empty
+type stagedFile struct {
+	name string
+	// path is where name is written: the file it links to if it is a symlink
+	path string
+	tmp  string
+	// previous content and mode, to roll back to; existed is false for new files
+	previous     []byte
+	previousMode os.FileMode
+	existed      bool
+	// previousLink is the target of path if it was a symlink
+	previousLink string
+}
+
+// fileTransaction replaces several files so that either all or none of them
+// change. Each file is staged to a synced temporary file in the same directory
+// and renamed over the destination, so a crash never leaves a truncated file.
+type fileTransaction struct {
+	staged []stagedFile
+	// dirs were created for staged files, parents first, and are removed on abort
+	dirs []string
+}
+
+// tempPattern names the temporary files of name, so that leftovers can be found
+func tempPattern(name string) string {
+	return "." + filepath.Base(name) + ".environ-*"
+}
+
+// writeTemp writes content to a synced temporary file next to name
+func writeTemp(name string, content []byte, mode os.FileMode) (string, error) {
+	file, err := os.CreateTemp(filepath.Dir(name), tempPattern(name))
+	if err != nil {
+		return "", err
+	}
+	tmp := file.Name()
+	_, err = file.Write(content)
+	if err == nil {
+		err = file.Chmod(mode)
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	return tmp, nil
+}
+
+// syncDir makes renames in dir durable
+func syncDir(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return file.Sync()
+}
+
+// readPrevious records the current content of path, written as name, to roll back to
+func readPrevious(name, path string) (stagedFile, error) {
+	staged := stagedFile{name: name, path: path}
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSymlink != 0 {
+		if staged.previousLink, err = os.Readlink(path); err != nil {
+			return staged, err
+		}
+	}
+	if info, err := os.Stat(path); err == nil {
+		previous, err := os.ReadFile(path)
+		if err != nil {
+			return staged, fmt.Errorf("failed to read %s: %w", name, err)
+		}
+		staged.previous = previous
+		staged.previousMode = info.Mode().Perm()
+		staged.existed = true
+	} else if !os.IsNotExist(err) {
+		return staged, err
+	}
+	return staged, nil
+}
+
+// resolveLink returns the file that name links to, so that replacing a
+// symlinked file writes through the link as before rather than replacing it.
+// Links out of the root are refused by checkWritablePath before staging.
+func resolveLink(name string) (string, error) {
+	info, err := os.Lstat(name)
+	if os.IsNotExist(err) {
+		return name, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if info.Mode()&os.ModeSymlink == 0 {
+		return name, nil
+	}
+	target, err := filepath.EvalSymlinks(name)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve symlink %s: %w", name, err)
+	}
+	return target, nil
+}
+
+// removeStaleTemps removes the temporary files of names left by an
+// interrupted transaction, which hold plaintext secrets
+func removeStaleTemps(names []string) (int, error) {
+	removed := 0
+	for _, name := range names {
+		// Symlinked files are staged next to their target
+		if path, err := resolveLink(name); err == nil {
+			name = path
+		}
+		matches, err := filepath.Glob(filepath.Join(filepath.Dir(name), tempPattern(name)))
+		if err != nil {
+			return removed, err
+		}
+		for _, match := range matches {
+			if err := os.Remove(match); err != nil && !os.IsNotExist(err) {
+				return removed, err
+			}
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+// mkdirs creates the missing parent directories of name, recording them
+func (t *fileTransaction) mkdirs(name string) error {
+	var missing []string
+	for dir := filepath.Dir(name); dir != "." && dir != "/"; dir = filepath.Dir(dir) {
+		if _, err := os.Stat(dir); err == nil {
+			break
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+		missing = append(missing, dir)
+	}
+	for i := len(missing) - 1; i >= 0; i-- {
+		if err := os.Mkdir(missing[i], 0755); err != nil {
+			return fmt.Errorf("failed to create directory %s: %w", missing[i], err)
+		}
+		t.dirs = append(t.dirs, missing[i])
+	}
+	return nil
+}
+
+// Stage writes the new content of name to a temporary file, creating its
+// directory if needed
+func (t *fileTransaction) Stage(name string, content []byte, mode os.FileMode) error {
+	path, err := resolveLink(name)
+	if err != nil {
+		return err
+	}
+	staged, err := readPrevious(name, path)
+	if err != nil {
+		return err
+	}
+	if err := t.mkdirs(path); err != nil {
+		return err
+	}
+
+	tmp, err := writeTemp(path, content, mode)
+	if err != nil {
+		return fmt.Errorf("failed to stage %s: %w", name, err)
+	}
+	staged.tmp = tmp
+	t.staged = append(t.staged, staged)
+	return nil
+}
+
+// StageRemoval marks an existing file to be removed on commit, or the link
+// if it is a symlink
+func (t *fileTransaction) StageRemoval(name string) error {
+	staged, err := readPrevious(name, name)
+	if err != nil {
+		return err
+	}
+	if !staged.existed {
+		return nil
+	}
+	t.staged = append(t.staged, staged)
+	return nil
+}
+
+// Commit renames every staged file over its destination, and removes the files
+// staged for removal. If any step fails, the files already replaced or removed
+// are restored to their previous content.
+func (t *fileTransaction) Commit() error {
+	dirs := make(map[string]bool)
+	for i, staged := range t.staged {
+		var err error
+		if staged.tmp == "" {
+			err = os.Remove(staged.path)
+		} else {
+			err = os.Rename(staged.tmp, staged.path)
+		}
+		if err != nil {
+			t.rollback(t.staged[:i])
+			t.Abort()
+			return fmt.Errorf("failed to replace %s: %w", staged.name, err)
+		}
+		dirs[filepath.Dir(staged.path)] = true
+	}
+	t.staged = nil
+	t.dirs = nil
+	for dir := range dirs {
+		if err := syncDir(dir); err != nil {
+			return fmt.Errorf("failed to sync %s: %w", dir, err)
+		}
+	}
+	return nil
+}
+
+// rollback restores files that were already replaced
+func (t *fileTransaction) rollback(replaced []stagedFile) {
+	for _, staged := range replaced {
+		var err error
+		switch {
+		case staged.previousLink != "":
+			err = os.Symlink(staged.previousLink, staged.path)
+		case !staged.existed:
+			err = os.Remove(staged.path)
+		default:
+			var tmp string
+			if tmp, err = writeTemp(staged.path, staged.previous, staged.previousMode); err == nil {
+				err = os.Rename(tmp, staged.path)
+			}
+		}
+		if err != nil {
+			log.Printf("Failed to restore %s: %s", staged.name, err)
+		}
+	}
+}
+
+// Abort removes the temporary files that were not renamed, and the directories
+// created for them
+func (t *fileTransaction) Abort() {
+	for _, staged := range t.staged {
+		if staged.tmp != "" {
+			os.Remove(staged.tmp)
+		}
+	}
+	t.staged = nil
+	for i := len(t.dirs) - 1; i >= 0; i-- {
+		os.Remove(t.dirs[i])
+	}
+	t.dirs = nil
+}
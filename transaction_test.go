@@ -0,0 +1,155 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileTransactionRollsBackOnFailure(t *testing.T) {
+	dir := t.TempDir()
+	existing := filepath.Join(dir, ".env")
+	created := filepath.Join(dir, ".env.prod")
+	broken := filepath.Join(dir, ".env.test")
+	if err := os.WriteFile(existing, []byte("OLD=1\n"), 0600); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+
+	var transaction fileTransaction
+	for _, name := range []string{existing, created, broken} {
+		if err := transaction.Stage(name, []byte("NEW=1\n"), 0600); err != nil {
+			t.Fatalf("Stage(%s) returned error: %v", name, err)
+		}
+	}
+	// Make the last rename fail
+	os.Remove(transaction.staged[2].tmp)
+
+	if err := transaction.Commit(); err == nil {
+		t.Fatalf("expected Commit to fail")
+	}
+	content, err := os.ReadFile(existing)
+	if err != nil || string(content) != "OLD=1\n" {
+		t.Fatalf("expected %s to be restored, got %q (%v)", existing, content, err)
+	}
+	if _, err := os.Stat(created); !os.IsNotExist(err) {
+		t.Fatalf("expected %s to be removed, got %v", created, err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("failed to list directory: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("expected only %s to remain, got %v", existing, entries)
+	}
+}
+
+func TestFileTransactionRestoresRemovedFileOnFailure(t *testing.T) {
+	dir := t.TempDir()
+	removed := filepath.Join(dir, "old.env")
+	broken := filepath.Join(dir, ".env")
+	if err := os.WriteFile(removed, []byte("OLD=1\n"), 0640); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+
+	var transaction fileTransaction
+	if err := transaction.StageRemoval(removed); err != nil {
+		t.Fatalf("StageRemoval returned error: %v", err)
+	}
+	if err := transaction.Stage(broken, []byte("NEW=1\n"), 0600); err != nil {
+		t.Fatalf("Stage returned error: %v", err)
+	}
+	os.Remove(transaction.staged[1].tmp)
+
+	if err := transaction.Commit(); err == nil {
+		t.Fatalf("expected Commit to fail")
+	}
+	content, err := os.ReadFile(removed)
+	if err != nil || string(content) != "OLD=1\n" {
+		t.Fatalf("expected %s to be restored, got %q (%v)", removed, content, err)
+	}
+}
+
+func TestFileTransactionRemovesCreatedDirectoriesOnFailure(t *testing.T) {
+	dir := t.TempDir()
+	nested := filepath.Join(dir, "agent", "config", ".env")
+	broken := filepath.Join(dir, ".env")
+
+	var transaction fileTransaction
+	for _, name := range []string{nested, broken} {
+		if err := transaction.Stage(name, []byte("NEW=1\n"), 0600); err != nil {
+			t.Fatalf("Stage(%s) returned error: %v", name, err)
+		}
+	}
+	os.Remove(transaction.staged[1].tmp)
+
+	if err := transaction.Commit(); err == nil {
+		t.Fatalf("expected Commit to fail")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "agent")); !os.IsNotExist(err) {
+		t.Fatalf("expected created directories to be removed, got %v", err)
+	}
+}
+
+func TestFileTransactionWritesThroughSymlinks(t *testing.T) {
+	t.Chdir(t.TempDir())
+	writeFile(t, "shared.env", "OLD=1\n", 0600)
+	writeFile(t, "removed.env", "OLD=1\n", 0600)
+	for link, target := range map[string]string{".env": "shared.env", "old.env": "removed.env"} {
+		if err := os.Symlink(target, link); err != nil {
+			t.Fatalf("failed to create symlink: %v", err)
+		}
+	}
+
+	var transaction fileTransaction
+	if err := transaction.Stage(".env", []byte("NEW=1\n"), 0600); err != nil {
+		t.Fatalf("Stage returned error: %v", err)
+	}
+	if err := transaction.StageRemoval("old.env"); err != nil {
+		t.Fatalf("StageRemoval returned error: %v", err)
+	}
+	if err := transaction.Stage(".env.test", []byte("NEW=1\n"), 0600); err != nil {
+		t.Fatalf("Stage returned error: %v", err)
+	}
+	os.Remove(transaction.staged[2].tmp)
+	if err := transaction.Commit(); err == nil {
+		t.Fatalf("expected Commit to fail")
+	}
+	if target, err := os.Readlink("old.env"); err != nil || target != "removed.env" {
+		t.Fatalf("expected old.env to be restored as a symlink, got %q (%v)", target, err)
+	}
+	if content := readFile(t, "shared.env"); content != "OLD=1\n" {
+		t.Fatalf("expected shared.env to be restored, got %q", content)
+	}
+
+	transaction = fileTransaction{}
+	if err := transaction.Stage(".env", []byte("NEW=1\n"), 0600); err != nil {
+		t.Fatalf("Stage returned error: %v", err)
+	}
+	if err := transaction.Commit(); err != nil {
+		t.Fatalf("Commit returned error: %v", err)
+	}
+	if target, err := os.Readlink(".env"); err != nil || target != "shared.env" {
+		t.Fatalf("expected .env to remain a symlink, got %q (%v)", target, err)
+	}
+	if content := readFile(t, "shared.env"); content != "NEW=1\n" {
+		t.Fatalf("expected shared.env to be written through the symlink, got %q", content)
+	}
+}
+
+func TestRemoveStaleTemps(t *testing.T) {
+	t.Chdir(t.TempDir())
+	writeFile(t, ".env", "KEEP=1\n", 0600)
+	writeFile(t, ".env.environ-123", "KEEP=1\n", 0600)
+	if _, err := writeTemp(".env", []byte("LEFT=1\n"), 0600); err != nil {
+		t.Fatalf("writeTemp returned error: %v", err)
+	}
+
+	removed, err := removeStaleTemps([]string{".env"})
+	if err != nil || removed != 1 {
+		t.Fatalf("expected 1 temporary file to be removed, got %d (%v)", removed, err)
+	}
+	entries, err := os.ReadDir(".")
+	if err != nil || len(entries) != 2 {
+		t.Fatalf("expected only .env and .env.environ-123 to remain, got %v (%v)", entries, err)
+	}
+}
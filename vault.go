@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"go.starlark.net/starlark"
+)
+
+func vaultfunc(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	addr := os.Getenv("VAULT_ADDR")
+	mount := "secret"
+	path := "environ"
+	tokenFile := ""
+	if err := starlark.UnpackArgs(fn.Name(), args, kwargs, "addr?", &addr, "mount?", &mount, "path?", &path, "token_file?", &tokenFile); err != nil {
+		return nil, err
+	}
+	if addr == "" {
+		return nil, fmt.Errorf("%s: addr is not set and neither is VAULT_ADDR", fn.Name())
+	}
+	mount, path = strings.Trim(mount, "/"), strings.Trim(path, "/")
+	if mount == "" || path == "" {
+		return nil, fmt.Errorf("%s: mount and path must not be empty", fn.Name())
+	}
+	return Vault{
+		addr:      strings.TrimSuffix(addr, "/"),
+		mount:     mount,
+		path:      path,
+		tokenFile: expandHome(tokenFile),
+		client:    &http.Client{Timeout: time.Minute},
+	}, nil
+}
+
+// Vault stores base64-encoded archives in a HashiCorp Vault KV v2 secrets
+// engine, one secret per archive. Overwrite adds a version, and the engine
+// keeps the previous ones up to its max_versions.
+type Vault struct {
+	addr  string
+	mount string
+	path  string
+	// Read on each request; VAULT_TOKEN or ~/.vault-token if empty
+	tokenFile string
+	client    *http.Client
+}
+
+// vaultSecret is the body of KV v2 reads and writes
+type vaultSecret struct {
+	Options map[string]int    `json:"options,omitempty"`
+	Data    map[string]string `json:"data"`
+}
+
+func (v Vault) token() (string, error) {
+	if v.tokenFile != "" {
+		return secret("", v.tokenFile)
+	}
+	if token := os.Getenv("VAULT_TOKEN"); token != "" {
+		return token, nil
+	}
+	return secret("", expandHome("~/.vault-token"))
+}
+
+// request builds a request to an API of the engine, data or metadata, for key
+func (v Vault) request(method, api, key string, body []byte) (*http.Request, error) {
+	request, err := http.NewRequest(method, fmt.Sprintf("%s/v1/%s/%s/%s/%s", v.addr, v.mount, api, v.path, key), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	token, err := v.token()
+	if err != nil {
+		// Not %w, a missing token file must not look like a missing archive
+		return nil, fmt.Errorf("failed to read Vault token: %v", err)
+	}
+	request.Header.Set("X-Vault-Token", token)
+	if namespace := os.Getenv("VAULT_NAMESPACE"); namespace != "" {
+		request.Header.Set("X-Vault-Namespace", namespace)
+	}
+	return request, nil
+}
+
+// vaultError reads the errors Vault reports in the body of a failed request
+func vaultError(request *http.Request, resp *http.Response) error {
+	var body struct {
+		Errors []string `json:"errors"`
+	}
+	json.NewDecoder(resp.Body).Decode(&body)
+	if len(body.Errors) > 0 {
+		return fmt.Errorf("%s %s: %s: %s", request.Method, request.URL.Redacted(), resp.Status, strings.Join(body.Errors, ", "))
+	}
+	return fmt.Errorf("%s %s: %s", request.Method, request.URL.Redacted(), resp.Status)
+}
+
+func (v Vault) Get(key string) ([]byte, error) {
+	request, err := v.request(http.MethodGet, "data", key, nil)
+	if err != nil {
+		return []byte{}, err
+	}
+	resp, err := v.client.Do(request)
+	if err != nil {
+		return []byte{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		// Also the answer for deleted versions
+		return []byte{}, httpNotFound(request.URL.Redacted())
+	}
+	if resp.StatusCode != http.StatusOK {
+		return []byte{}, vaultError(request, resp)
+	}
+	var body struct {
+		Data vaultSecret `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return []byte{}, fmt.Errorf("failed to decode %s: %w", request.URL.Redacted(), err)
+	}
+	archive, ok := body.Data.Data["archive"]
+	if !ok {
+		return []byte{}, fmt.Errorf("%s has no archive", request.URL.Redacted())
+	}
+	return base64.StdEncoding.DecodeString(archive)
+}
+
+// currentVersion reads the latest version of a secret, deleted or not
+func (v Vault) currentVersion(key string) (int, error) {
+	request, err := v.request(http.MethodGet, "metadata", key, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := v.client.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, vaultError(request, resp)
+	}
+	var body struct {
+		Data struct {
+			CurrentVersion int `json:"current_version"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return 0, fmt.Errorf("failed to decode %s: %w", request.URL.Redacted(), err)
+	}
+	return body.Data.CurrentVersion, nil
+}
+
+// put writes a new version of a secret and returns the status Vault answered
+func (v Vault) put(key string, value []byte, options map[string]int) (int, error) {
+	payload := vaultSecret{Options: options, Data: map[string]string{"archive": base64.StdEncoding.EncodeToString(value)}}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return 0, err
+	}
+	request, err := v.request(http.MethodPost, "data", key, body)
+	if err != nil {
+		return 0, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	resp, err := v.client.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, vaultError(request, resp)
+	}
+	return resp.StatusCode, nil
+}
+
+func (v Vault) Write(key string, value []byte) error {
+	// Check-and-set with version 0 only writes if the secret doesn't exist
+	status, err := v.put(key, value, map[string]int{"cas": 0})
+	if err == nil || status != http.StatusBadRequest {
+		return err
+	}
+	// Vault answers 400 to a failed check-and-set, as to other bad requests
+	_, getErr := v.Get(key)
+	if getErr == nil {
+		// Already there
+		return nil
+	}
+	if !isNotFound(getErr) {
+		return err
+	}
+	// The latest version was deleted but not destroyed: write over it
+	version, metadataErr := v.currentVersion(key)
+	if metadataErr != nil {
+		return fmt.Errorf("%w, and failed to check whether %s was deleted: %w", err, key, metadataErr)
+	}
+	if version == 0 {
+		return err
+	}
+	_, err = v.put(key, value, map[string]int{"cas": version})
+	return err
+}
+
+func (v Vault) Overwrite(key string, value []byte) error {
+	_, err := v.put(key, value, nil)
+	return err
+}
+
+func (v Vault) String() string {
+	return fmt.Sprintf("vault(%s, %s, %s)", v.addr, v.mount, v.path)
+}
+
+func (v Vault) Type() string {
+	return "Vault"
+}
+
+func (v Vault) Freeze() {
+}
+
+func (v Vault) Truth() starlark.Bool {
+	return starlark.Bool(true)
+}
+
+func (v Vault) Hash() (uint32, error) {
+	return starlark.String(v.String()).Hash()
+}
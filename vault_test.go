@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"go.starlark.net/starlark"
+)
+
+// fakeVault implements KV v2 reads, writes with check-and-set, soft deletes
+// and version metadata for the secret mount
+func fakeVault(t *testing.T, token string) (*httptest.Server, map[string]map[string]string) {
+	t.Helper()
+	var mu sync.Mutex
+	secrets := make(map[string]map[string]string)
+	versions := make(map[string]int)
+	deleted := make(map[string]bool)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != token {
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(map[string][]string{"errors": {"permission denied"}})
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if path, ok := strings.CutPrefix(r.URL.Path, "/v1/secret/metadata/"); ok && r.Method == http.MethodGet {
+			if versions[path] == 0 {
+				w.WriteHeader(http.StatusNotFound)
+				json.NewEncoder(w).Encode(map[string][]string{"errors": {}})
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]any{"data": map[string]int{"current_version": versions[path]}})
+			return
+		}
+		path, ok := strings.CutPrefix(r.URL.Path, "/v1/secret/data/")
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			data, ok := secrets[path]
+			if !ok || deleted[path] {
+				w.WriteHeader(http.StatusNotFound)
+				json.NewEncoder(w).Encode(map[string][]string{"errors": {}})
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]any{"data": map[string]any{"data": data}})
+		case http.MethodPost, http.MethodPut:
+			var body vaultSecret
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			if cas, ok := body.Options["cas"]; ok && cas != versions[path] {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(map[string][]string{"errors": {"check-and-set parameter did not match the current version"}})
+				return
+			}
+			secrets[path] = body.Data
+			versions[path]++
+			deleted[path] = false
+			json.NewEncoder(w).Encode(map[string]any{"data": map[string]int{"version": versions[path]}})
+		case http.MethodDelete:
+			deleted[path] = true
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server, secrets
+}
+
+func TestVaultStoresBase64WithCheckAndSet(t *testing.T) {
+	t.Setenv("VAULT_TOKEN", "s.token")
+	server, secrets := fakeVault(t, "s.token")
+	remote := Vault{addr: server.URL, mount: "secret", path: "environ", client: server.Client()}
+
+	if err := remote.Write("id", []byte("first\x00")); err != nil {
+		t.Fatalf("Write returned error: %v", err)
+	}
+	if secrets["environ/id"]["archive"] != "Zmlyc3QA" {
+		t.Fatalf("expected the archive to be stored base64-encoded, got %v", secrets["environ/id"])
+	}
+	// The fake rejects it like Vault, with a 400
+	if err := remote.Write("id", []byte("second")); err != nil {
+		t.Fatalf("Write of an existing archive returned error: %v", err)
+	}
+	if secrets["environ/id"]["archive"] != "Zmlyc3QA" {
+		t.Fatalf("expected check-and-set to keep the archive, got %v", secrets["environ/id"])
+	}
+}
+
+func TestVaultPermissionDeniedIsNotNotFound(t *testing.T) {
+	t.Setenv("VAULT_TOKEN", "s.wrong")
+	server, _ := fakeVault(t, "s.token")
+	remote := Vault{addr: server.URL, mount: "secret", path: "environ", client: server.Client()}
+
+	_, err := remote.Get("missing")
+	if err == nil || isNotFound(err) || !strings.Contains(err.Error(), "permission denied") {
+		t.Fatalf("expected a permission error distinct from not found, got %v", err)
+	}
+	if err := remote.Write("id", []byte("content")); err == nil {
+		t.Fatalf("expected Write with a wrong token to fail")
+	}
+}
+
+func TestVaultWriteReplacesDeletedSecrets(t *testing.T) {
+	t.Setenv("VAULT_TOKEN", "s.token")
+	server, _ := fakeVault(t, "s.token")
+	remote := Vault{addr: server.URL, mount: "secret", path: "environ", client: server.Client()}
+
+	if err := remote.Write("id", []byte("content")); err != nil {
+		t.Fatalf("Write returned error: %v", err)
+	}
+	request, err := remote.request(http.MethodDelete, "data", "id", nil)
+	if err != nil {
+		t.Fatalf("failed to build request: %v", err)
+	}
+	if resp, err := server.Client().Do(request); err != nil {
+		t.Fatalf("failed to delete secret: %v", err)
+	} else {
+		resp.Body.Close()
+	}
+	if _, err := remote.Get("id"); !isNotFound(err) {
+		t.Fatalf("expected the deleted secret not to be found, got %v", err)
+	}
+
+	if err := remote.Write("id", []byte("content")); err != nil {
+		t.Fatalf("Write over a deleted secret returned error: %v", err)
+	}
+	if content, err := remote.Get("id"); err != nil || string(content) != "content" {
+		t.Fatalf("expected the secret to be written again, got %q (%v)", content, err)
+	}
+}
+
+func TestVaultRejectsEmptyPath(t *testing.T) {
+	kwargs := []starlark.Tuple{
+		{starlark.String("addr"), starlark.String("http://127.0.0.1:8200")},
+		{starlark.String("path"), starlark.String("/")},
+	}
+	if _, err := starlark.Call(&starlark.Thread{}, starlark.NewBuiltin("vault", vaultfunc), nil, kwargs); err == nil {
+		t.Fatalf("expected an empty path to be rejected")
+	}
+}